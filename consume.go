@@ -0,0 +1,62 @@
+package dispatcher
+
+import "math/rand"
+
+// WeightedQueue is a queue consumed by the background runners.
+//
+// When every queue has a weight of 0 the queues are consumed in strict
+// priority, in the order they are listed. Otherwise the runners order them
+// by a weighted random draw before every pop, so with weights of 6, 3 and 1
+// the first queue is checked first six times as often as the last one.
+// Queues with a weight of 0 are always checked after the weighted ones.
+type WeightedQueue struct {
+	Name   string
+	Weight int
+}
+
+type consumedQueues []WeightedQueue
+
+func (queues consumedQueues) contains(queue string) bool {
+	for i := range queues {
+		if queues[i].Name == queue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// order returns the names of the queues in the order the next pop should
+// check them.
+func (queues consumedQueues) order() []string {
+	names := make([]string, 0, len(queues))
+	weighted := make([]WeightedQueue, 0, len(queues))
+	total := 0
+	for _, queue := range queues {
+		if queue.Weight > 0 {
+			weighted = append(weighted, queue)
+			total += queue.Weight
+		}
+	}
+
+	for len(weighted) > 0 {
+		pick := rand.Intn(total)
+		for i, queue := range weighted {
+			if pick < queue.Weight {
+				names = append(names, queue.Name)
+				total -= queue.Weight
+				weighted = append(weighted[:i], weighted[i+1:]...)
+				break
+			}
+			pick -= queue.Weight
+		}
+	}
+
+	for _, queue := range queues {
+		if queue.Weight <= 0 {
+			names = append(names, queue.Name)
+		}
+	}
+
+	return names
+}
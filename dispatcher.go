@@ -4,30 +4,41 @@ import (
 	"context"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ZutrixPog/dispatcher/history"
-	"github.com/ZutrixPog/dispatcher/queue"
+	tq "github.com/ZutrixPog/dispatcher/queue"
 	"github.com/ZutrixPog/dispatcher/queue/mem"
 	serial "github.com/ZutrixPog/dispatcher/serialization"
 )
 
 const (
-	BgQueue      = "bg-queue"
+	BgQueue      = tq.BgQueue
 	BG_PRODUCERS = 5
+
+	// OriginQueueHeader is the header naming the queue a dead task failed in.
+	OriginQueueHeader = "origin-queue"
+
+	popRetryInterval = time.Second
+	dispatchBatch    = 100
 )
 
 type Dispatcher interface {
 	Task(task any, executor Executor) error
 
-	Spawn(queue string, task Task) (int, error)
+	Spawn(queue string, task Task, opts ...SpawnOption) (int, error)
+
+	SpawnWith(pusher tq.Pusher, queue string, task Task, opts ...SpawnOption) (int, error)
 
 	SpawnTimer(executor Executor, interval time.Duration)
 
-	SpawnBg(task Task) (int, error)
+	SpawnBg(task Task, opts ...SpawnOption) (int, error)
 
 	SpawnRealtimeBg(executor RealtimeExecutor)
 
+	SpawnSaga(queue string, saga *Saga) (string, error)
+
 	Dispatch(ctx context.Context, queue string) error
 
 	DispatchAll(ctx context.Context, queue string)
@@ -36,51 +47,114 @@ type Dispatcher interface {
 
 	RetrivePendingTasks(ctx context.Context, queue string) []history.TaskReport
 
-	Remove(queue string, index int) error
+	ListPendingTasks(ctx context.Context, queue string, page tq.Page) ([]history.TaskReport, error)
+
+	Remove(ctx context.Context, queue string, index int) error
 
 	RetrieveTaskHistory(ctx context.Context, query history.Query) []history.TaskReport
 
+	PauseQueue(ctx context.Context, queue string) error
+
+	ResumeQueue(ctx context.Context, queue string) error
+
+	PurgeQueue(ctx context.Context, queue string) (int, error)
+
+	DeleteTasks(ctx context.Context, queue string, filter tq.Filter) (int, error)
+
+	MoveTasks(ctx context.Context, from, to string, filter tq.Filter) (int, error)
+
+	ListQueues(ctx context.Context) ([]string, error)
+
+	QueueStats(ctx context.Context, queue string) (tq.Stats, error)
+
 	Release()
 }
 
 type TaskDispatcher struct {
-	queue   queue.TaskQueue
-	history history.TaskHistoryRepo
-	pool    *WorkerPool
-	ctx     context.Context
-	cancel  context.CancelFunc
+	queue      tq.TaskQueue
+	history    history.TaskHistoryRepo
+	pool       *WorkerPool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	bgQueue    string
+	deadLetter string
+	serializer serial.Serializer
+	// serializers are the serializers tasks are read with, the one they are
+	// written with first.
+	serializers []serial.Serializer
+	envelope    bool
+	compressor  serial.Compressor
+	// compressAbove is the size from which payloads are compressed.
+	compressAbove int
+	// compressors are the compressors payloads are decompressed with.
+	compressors []serial.Compressor
+	keys        KeyProvider
+	logger      Logger
+	clock       func() time.Time
+	newID       func() string
 
 	types     *sync.Map
 	executors *sync.Map
+	consumed  consumedQueues
+	// runners tracks the background runners, which push back the tasks
+	// they popped but did not start when the dispatcher is released.
+	runners sync.WaitGroup
+	// released fails the spawns following Release.
+	released atomic.Bool
 }
 
-func Default(runners int, limit int64) Dispatcher {
-	return Init(mem.NewQueue(limit), &history.DummyTaskHistoryRepo{}, runners)
-}
-
-func Init(queue queue.TaskQueue, historyrepo history.TaskHistoryRepo, runners int) Dispatcher {
-	if historyrepo == nil {
-		historyrepo = &history.DummyTaskHistoryRepo{}
-	}
+// New creates a dispatcher. Without options it keeps tasks in memory and
+// its background runners consume BgQueue.
+func New(opts ...Option) Dispatcher {
+	o := defaultOptions()
+	o.apply(opts)
 
-	pool := NewPool(runners)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(o.ctx)
 	d := &TaskDispatcher{
-		queue,
-		historyrepo,
-		pool,
-		ctx,
-		cancel,
-		&sync.Map{},
-		&sync.Map{},
+		queue:         o.queue,
+		history:       o.history,
+		pool:          newPool(o.workers, o.workerTimeout),
+		ctx:           ctx,
+		cancel:        cancel,
+		bgQueue:       o.bgQueue,
+		deadLetter:    o.deadLetter,
+		serializer:    o.serializer,
+		envelope:      o.envelope,
+		serializers:   append(append([]serial.Serializer{o.serializer}, o.readable...), serial.Builtin()...),
+		compressor:    o.compressor,
+		compressAbove: o.compressAbove,
+		compressors:   append(o.compressors, serial.BuiltinCompressors()...),
+		keys:          o.keys,
+		logger:        o.logger,
+		clock:         o.clock,
+		newID:         o.newID,
+		types:         &sync.Map{},
+		executors:     &sync.Map{},
+		consumed:      o.consumed,
+	}
+	// the runners share the pool, so no more tasks are popped ahead of
+	// running them than the pool can run.
+	prefetch := 1
+	if o.producers > 0 && o.workers/o.producers > 1 {
+		prefetch = o.workers / o.producers
 	}
-	for i := 0; i < BG_PRODUCERS; i++ {
-		d.initRunner()
+	for i := 0; i < o.producers; i++ {
+		d.initRunner(prefetch)
 	}
 
 	return d
 }
 
+func Default(runners int, limit int64) Dispatcher {
+	return New(WithQueue(mem.NewQueue(limit)), WithWorkers(runners))
+}
+
+// Init creates a dispatcher whose background runners consume the given
+// queues, or only BgQueue when none are given.
+func Init(queue tq.TaskQueue, historyrepo history.TaskHistoryRepo, runners int, consumed ...WeightedQueue) Dispatcher {
+	return New(WithQueue(queue), WithHistory(historyrepo), WithWorkers(runners), WithQueues(consumed...))
+}
+
 func (tm *TaskDispatcher) Task(task any, executor Executor) error {
 	if !isPointer(task) {
 		return ErrTaskNotPtr
@@ -99,38 +173,65 @@ func (tm *TaskDispatcher) SpawnTimer(executor Executor, interval time.Duration)
 	tm.spawnTimer(executor, ticker)
 }
 
-func (tm *TaskDispatcher) initRunner() {
+// initRunner consumes the consumed queues until the dispatcher is released,
+// popping at most prefetch tasks ahead of running them. A failing backend is
+// retried after popRetryInterval.
+func (tm *TaskDispatcher) initRunner(prefetch int) {
+	tm.runners.Add(1)
 	go func() {
+		defer tm.runners.Done()
 		for {
+			stream := tq.ConsumeFunc(tm.ctx, tm.queue, tm.consumed.order, prefetch)
+			for delivery := range stream.Deliveries() {
+				tm.run(delivery)
+			}
+			if tm.ctx.Err() != nil {
+				if err := stream.Err(); err != tm.ctx.Err() {
+					tm.logger.Printf("dispatcher: failed to push back prefetched tasks: %v", err)
+				}
+				return
+			}
+
+			tm.logger.Printf("dispatcher: failed to pop background task: %v", stream.Err())
 			select {
 			case <-tm.ctx.Done():
 				return
-			case task := <-tm.queue.BlockingPop(BgQueue):
-				decodedTask, wrapper, err := tm.deserialize(task)
-				if err != nil {
-					continue
-				}
-
-				tm.pool.Submit(func() {
-					execute, _ := tm.executors.Load(wrapper.Type)
-
-					if _, ok := execute.(Executor); !ok {
-						return
-					}
-					err = execute.(Executor)(tm.ctx, decodedTask)
-					if err != nil && wrapper.Retries > 0 {
-						wrapper.Retries--
-						encodedTask, err := serial.Serialize(decodedTask)
-						if err == nil {
-							tm.queue.Push(BgQueue, encodedTask)
-						}
-					}
-				})
+			case <-time.After(popRetryInterval):
 			}
 		}
 	}()
 }
 
+// run hands a delivery to the pool, or pushes it back to its queue when the
+// dispatcher is released first.
+func (tm *TaskDispatcher) run(delivery *tq.Delivery) {
+	submitted := tm.pool.submit(tm.ctx, func() {
+		err := tm.dispatch(tm.ctx, delivery.Data, delivery.Queue)
+		if err != nil {
+			tm.logger.Printf("dispatcher: background task from %s failed: %v", delivery.Queue, err)
+		}
+		// a retry that could not be requeued pushes back the delivery as it
+		// was popped, so the task is not lost.
+		if err == ErrRequeue {
+			if err := delivery.Nack(context.Background()); err != nil {
+				tm.logger.Printf("dispatcher: failed to push back %s task to %s: %v", delivery.Type, delivery.Queue, err)
+			}
+			return
+		}
+		// a handled task is acknowledged even while the dispatcher shuts down.
+		if err := delivery.Ack(context.Background()); err != nil {
+			tm.logger.Printf("dispatcher: failed to acknowledge %s task from %s: %v", delivery.Type, delivery.Queue, err)
+		}
+	})
+	if submitted {
+		return
+	}
+
+	if err := delivery.Nack(context.Background()); err != nil {
+		tm.logger.Printf("dispatcher: failed to push back %s task to %s: %v", delivery.Type, delivery.Queue, err)
+	}
+}
+
 func (tm *TaskDispatcher) spawnTimer(exec Executor, ticker *time.Ticker) {
 	go func() {
 		for {
@@ -145,7 +246,18 @@ func (tm *TaskDispatcher) spawnTimer(exec Executor, ticker *time.Ticker) {
 	}()
 }
 
-func (tm *TaskDispatcher) Spawn(queue string, task Task) (int, error) {
+func (tm *TaskDispatcher) Spawn(queue string, task Task, opts ...SpawnOption) (int, error) {
+	return tm.SpawnWith(tm.queue, queue, task, opts...)
+}
+
+// SpawnWith spawns a task like Spawn but hands it to the given pusher instead
+// of the queue of the dispatcher, like an outbox writing it within a
+// transaction of the application database. Spawning to a released
+// dispatcher fails with ErrDispatcherClosed.
+func (tm *TaskDispatcher) SpawnWith(pusher tq.Pusher, queue string, task Task, opts ...SpawnOption) (int, error) {
+	if tm.released.Load() {
+		return 0, ErrDispatcherClosed
+	}
 	if _, exists := tm.types.Load(task.Type()); !exists {
 		return 0, ErrUnregisteredTask
 	}
@@ -153,16 +265,25 @@ func (tm *TaskDispatcher) Spawn(queue string, task Task) (int, error) {
 		return 0, ErrTaskAlreadyExists
 	}
 
-	encodedTask, err := serial.Serialize(task)
+	encodedTask, err := tm.serializer.Serialize(task)
 	if err != nil {
 		return 0, err
 	}
 
-	data, err := serial.Serialize(TaskWrapper{Type: task.Type(), Task: encodedTask, Submitted: time.Now(), Retries: task.Retry()})
+	options := newSpawnOptions(tm.ctx, task, opts)
+	return tm.pushTo(options.ctx, pusher, queue, TaskWrapper{ID: tm.newID(), Type: task.Type(), Codec: tm.serializer.Codec(), Task: encodedTask, Submitted: tm.clock(), Retries: task.Retry(), Priority: options.priority, Headers: options.headers})
+}
+
+func (tm *TaskDispatcher) push(ctx context.Context, queue string, wrapper TaskWrapper) (int, error) {
+	return tm.pushTo(ctx, tm.queue, queue, wrapper)
+}
+
+func (tm *TaskDispatcher) pushTo(ctx context.Context, pusher tq.Pusher, queue string, wrapper TaskWrapper) (int, error) {
+	data, err := tm.encodeWrapper(wrapper)
 	if err != nil {
 		return 0, err
 	}
-	index, err := tm.queue.Push(queue, data)
+	index, err := pusher.Push(ctx, queue, tq.Message{Type: wrapper.Type, Headers: wrapper.Headers, Priority: wrapper.Priority, Data: data})
 	if err != nil {
 		return 0, err
 	}
@@ -170,23 +291,30 @@ func (tm *TaskDispatcher) Spawn(queue string, task Task) (int, error) {
 	return index, nil
 }
 
-func (tm *TaskDispatcher) TaskExists(ctx context.Context, queue, taskType string) bool {
-	if queue == BgQueue {
-		return false
+// requeue queues again a task the dispatcher popped, to be retried, advanced
+// or dead-lettered. It is not given up when the dispatcher shuts down, nor
+// rejected by the limit of the queue, since the popped task is acknowledged
+// once handled and would be lost otherwise.
+func (tm *TaskDispatcher) requeue(queue string, wrapper TaskWrapper) error {
+	data, err := tm.encodeWrapper(wrapper)
+	if err != nil {
+		return err
 	}
-	tasks := tm.RetrivePendingTasks(ctx, queue)
 
-	for i := range tasks {
-		if tasks[i].Type == taskType {
-			return true
-		}
+	return tm.queue.Requeue(context.Background(), queue, tq.Message{Type: wrapper.Type, Headers: wrapper.Headers, Priority: wrapper.Priority, Data: data})
+}
+
+func (tm *TaskDispatcher) TaskExists(ctx context.Context, queue, taskType string) bool {
+	if queue == tm.bgQueue || tm.consumed.contains(queue) {
+		return false
 	}
+	tasks, err := tm.queue.List(ctx, queue, tq.Page{Filter: tq.Filter{Type: taskType}, Limit: 1})
 
-	return false
+	return err == nil && len(tasks) > 0
 }
 
-func (tm *TaskDispatcher) SpawnBg(task Task) (int, error) {
-	i, err := tm.Spawn(BgQueue, task)
+func (tm *TaskDispatcher) SpawnBg(task Task, opts ...SpawnOption) (int, error) {
+	i, err := tm.Spawn(tm.bgQueue, task, opts...)
 	if err != nil {
 		return 0, err
 	}
@@ -201,13 +329,30 @@ func (tm *TaskDispatcher) SpawnRealtimeBg(exec RealtimeExecutor) {
 }
 
 func (tm *TaskDispatcher) Dispatch(ctx context.Context, queue string) error {
-	task, err := tm.queue.Pop(queue)
+	task, err := tm.queue.Pop(ctx, queue)
 	if err != nil {
 		return err
 	}
+	err = tm.dispatch(ctx, task.Data, queue)
+	tm.ack(task, err)
+
+	return err
+}
 
-	return tm.dispatch(ctx, task, queue)
+// ack acknowledges a popped task once it was handled, whether it succeeded,
+// was pushed again to be retried or failed for good. A retry that could not
+// be requeued stays pending, as does the task of a dispatcher that dies
+// while executing it, to be delivered again.
+func (tm *TaskDispatcher) ack(task tq.Message, err error) {
+	acker, ok := tm.queue.(tq.Acker)
+	if !ok || err == ErrRequeue {
+		return
+	}
 
+	// a handled task is acknowledged even while the dispatcher shuts down.
+	if err := acker.Ack(context.Background(), task); err != nil {
+		tm.logger.Printf("dispatcher: failed to acknowledge %s task from %s: %v", task.Type, task.Queue, err)
+	}
 }
 
 func (tm *TaskDispatcher) dispatch(ctx context.Context, task []byte, queue string) error {
@@ -220,6 +365,7 @@ func (tm *TaskDispatcher) dispatch(ctx context.Context, task []byte, queue strin
 		Type:      decodedTask.(Task).Type(),
 		Status:    "success",
 		Queue:     queue,
+		Priority:  wrapper.Priority,
 		Submitted: wrapper.Submitted,
 	}
 
@@ -227,91 +373,137 @@ func (tm *TaskDispatcher) dispatch(ctx context.Context, task []byte, queue strin
 
 	err = execute.(Executor)(ctx, decodedTask)
 	if err != nil {
-		if decodedTask.(Task).Retry() > 0 {
-			tm.queue.Push(queue, task)
+		wrapper.Attempts++
+		if wrapper.Retries > 0 {
+			wrapper.Retries--
+			if err := tm.requeue(queue, wrapper); err != nil {
+				tm.logger.Printf("dispatcher: failed to requeue %s task to %s: %v", wrapper.Type, queue, err)
+				return ErrRequeue
+			}
 			return nil
 		} else {
 			report.Status = "failed"
+			// failed steps are compensated, but failed compensations
+			// have nothing left to undo them.
+			if wrapper.Saga == nil || wrapper.Saga.Compensating {
+				tm.deadLetterTask(queue, decodedTask.(Task), wrapper)
+			}
 		}
 	}
 
-	if report.Queue != BgQueue {
-		go tm.history.Append(context.Background(), report)
+	if wrapper.Saga != nil {
+		report.Saga = wrapper.Saga.ID
+		tm.advanceSaga(queue, *wrapper.Saga, err == nil)
+	}
+
+	if report.Queue != tm.bgQueue {
+		go tm.appendHistory(report)
 	}
 	return err
 }
 
+// DispatchFilter pops the first task of the given type in one atomic step
+// of the backend, so concurrent dispatchers never run the same task.
 func (tm *TaskDispatcher) DispatchFilter(ctx context.Context, queue string, t Task) error {
-	tlist, err := tm.queue.List(queue)
+	task, err := tm.queue.PopFilter(ctx, queue, tq.Filter{Type: t.Type()})
+	if err == ErrEmptyQueue {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	for i, task := range tlist {
-		_, wrapper, err := tm.deserialize(task)
-		if err != nil {
-			return err
-		}
+	err = tm.dispatch(ctx, task.Data, queue)
+	tm.ack(task, err)
 
-		if wrapper.Type == t.Type() {
-			tm.dispatch(ctx, task, queue)
-			tm.queue.Remove(queue, i)
-			return nil
-		}
-	}
-
-	return nil
+	return err
 }
 
+// DispatchAll pops the tasks of the queue dispatchBatch at a time and runs
+// them in order until the queue is empty or a task fails. The rest of the
+// batch of a failed task still runs, since it was popped already.
 func (tm *TaskDispatcher) DispatchAll(ctx context.Context, queue string) {
 	for {
-		err := tm.Dispatch(ctx, queue)
+		tasks, err := tm.queue.PopN(ctx, queue, dispatchBatch)
 		if err != nil {
 			return
 		}
+
+		failed := false
+		for _, task := range tasks {
+			err := tm.dispatch(ctx, task.Data, queue)
+			if err != nil {
+				failed = true
+			}
+			tm.ack(task, err)
+		}
+		if failed {
+			return
+		}
 	}
 }
 
 func (tm *TaskDispatcher) RetrivePendingTasks(ctx context.Context, queue string) []history.TaskReport {
-	tasks, err := tm.queue.List(queue)
+	reports, _ := tm.ListPendingTasks(ctx, queue, tq.Page{})
+	return reports
+}
+
+// ListPendingTasks reports the pending tasks of the queue the page selects,
+// leaving the selection to the backend so only the tasks of the page are
+// decoded. The ID of a report is the index of its task in the queue as long
+// as the page selects tasks by position only.
+func (tm *TaskDispatcher) ListPendingTasks(ctx context.Context, queue string, page tq.Page) ([]history.TaskReport, error) {
+	tasks, err := tm.queue.List(ctx, queue, page)
+	if err == tq.ErrEmptyQueue {
+		return nil, nil
+	}
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	status := "pending"
+	if paused, _ := tm.queue.Paused(ctx, queue); paused {
+		status = "paused"
 	}
 
 	res := make([]history.TaskReport, len(tasks))
 	for i := range tasks {
-		_, wrapper, _ := tm.deserialize(tasks[i])
+		_, wrapper, _ := tm.deserialize(tasks[i].Data)
 
 		res[i] = history.TaskReport{
-			ID:        uint(i),
+			ID:        uint(page.Offset + i),
 			Type:      wrapper.Type,
-			Status:    "pending",
+			Status:    status,
 			Queue:     queue,
+			Priority:  tasks[i].Priority,
 			Submitted: wrapper.Submitted.UTC(),
 		}
 	}
 
-	return res
+	return res, nil
 }
 
-func (tm *TaskDispatcher) Remove(queue string, index int) error {
-	data, err := tm.queue.Get(queue, index)
+func (tm *TaskDispatcher) Remove(ctx context.Context, queue string, index int) error {
+	data, err := tm.queue.Get(ctx, queue, index)
 	if err != nil {
 		return err
 	}
 
-	task, wrapper, err := tm.deserialize(data)
+	task, wrapper, err := tm.deserialize(data.Data)
 	if err != nil {
 		return err
 	}
 
-	tm.history.Append(context.Background(), history.TaskReport{
+	tm.history.Append(ctx, history.TaskReport{
 		Type:      task.(Task).Type(),
 		Status:    "removed",
 		Queue:     queue,
+		Priority:  wrapper.Priority,
 		Submitted: wrapper.Submitted.UTC(),
 	})
-	return tm.queue.Remove(queue, index)
+	// the task is removed by ID, since another one may be at the index by
+	// now.
+	return tm.queue.RemoveID(ctx, queue, data.ID)
 }
 
 func (tm *TaskDispatcher) RetrieveTaskHistory(ctx context.Context, query history.Query) []history.TaskReport {
@@ -323,26 +515,255 @@ func (tm *TaskDispatcher) RetrieveTaskHistory(ctx context.Context, query history
 	return pending
 }
 
+// PauseQueue stops every dispatcher sharing the queue backend from
+// dispatching tasks of the queue. Tasks can still be spawned to it.
+func (tm *TaskDispatcher) PauseQueue(ctx context.Context, queue string) error {
+	return tm.queue.Pause(ctx, queue)
+}
+
+func (tm *TaskDispatcher) ResumeQueue(ctx context.Context, queue string) error {
+	return tm.queue.Resume(ctx, queue)
+}
+
+// PurgeQueue removes every task of the queue and returns how many were
+// removed.
+func (tm *TaskDispatcher) PurgeQueue(ctx context.Context, queue string) (int, error) {
+	return tm.DeleteTasks(ctx, queue, tq.Filter{})
+}
+
+// DeleteTasks removes the tasks of the queue matching the filter and returns
+// how many were removed.
+func (tm *TaskDispatcher) DeleteTasks(ctx context.Context, queue string, filter tq.Filter) (int, error) {
+	removed, err := tm.queue.Delete(ctx, queue, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	tm.reportTasks(removed, "removed")
+	return len(removed), nil
+}
+
+// MoveTasks moves the tasks matching the filter from one queue to another,
+// like tasks of the dead letter queue back to where they failed, and returns
+// how many were moved.
+func (tm *TaskDispatcher) MoveTasks(ctx context.Context, from, to string, filter tq.Filter) (int, error) {
+	moved, err := tm.queue.Move(ctx, from, to, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	tm.reportTasks(moved, "moved")
+	return len(moved), nil
+}
+
+// ListQueues lists every queue tasks have been spawned to.
+func (tm *TaskDispatcher) ListQueues(ctx context.Context) ([]string, error) {
+	return tm.queue.ListQueues(ctx)
+}
+
+// QueueStats returns the length, the age of the oldest task and the
+// enqueue and dequeue counters of the queue without decoding its tasks.
+func (tm *TaskDispatcher) QueueStats(ctx context.Context, queue string) (tq.Stats, error) {
+	return tm.queue.QueueStats(ctx, queue)
+}
+
+func (tm *TaskDispatcher) reportTasks(tasks []tq.Message, status string) {
+	for _, task := range tasks {
+		wrapper, err := tm.decodeWrapper(task.Data)
+		if err != nil {
+			tm.logger.Printf("dispatcher: failed to decode %s task of %s: %v", status, task.Queue, err)
+			continue
+		}
+
+		tm.appendHistory(history.TaskReport{
+			Type:      wrapper.Type,
+			Status:    status,
+			Queue:     task.Queue,
+			Priority:  task.Priority,
+			Submitted: wrapper.Submitted.UTC(),
+		})
+	}
+}
+
+func (tm *TaskDispatcher) deadLetterTask(queue string, task Task, wrapper TaskWrapper) {
+	if tm.deadLetter == "" || queue == tm.deadLetter {
+		return
+	}
+
+	headers := make(map[string]string, len(wrapper.Headers)+1)
+	for key, value := range wrapper.Headers {
+		headers[key] = value
+	}
+	headers[OriginQueueHeader] = queue
+	wrapper.Headers = headers
+	wrapper.Retries = task.Retry()
+
+	if err := tm.requeue(tm.deadLetter, wrapper); err != nil {
+		tm.logger.Printf("dispatcher: failed to move %s from %s to the dead letter queue: %v", wrapper.Type, queue, err)
+	}
+}
+
 func (tm *TaskDispatcher) deserialize(task []byte) (any, TaskWrapper, error) {
-	var wrapper TaskWrapper
-	if err := serial.Deserialize(task, &wrapper); err != nil {
+	wrapper, err := tm.decodeWrapper(task)
+	if err != nil {
 		return nil, TaskWrapper{}, err
 	}
 
-	t, _ := tm.types.Load(wrapper.Type)
-	if err := serial.Deserialize(wrapper.Task, t); err != nil {
+	t, ok := tm.types.Load(wrapper.Type)
+	if !ok {
+		return nil, TaskWrapper{}, ErrUnregisteredTask
+	}
+
+	serializer, err := tm.codec(wrapper.Codec)
+	if err != nil {
+		return nil, TaskWrapper{}, err
+	}
+
+	payload, err := tm.decrypt(wrapper)
+	if err != nil {
+		return nil, TaskWrapper{}, err
+	}
+	payload, err = tm.decompress(wrapper.Compression, payload)
+	if err != nil {
+		return nil, TaskWrapper{}, err
+	}
+
+	decodedTask := reflect.New(reflect.TypeOf(t).Elem()).Interface()
+	if err := serializer.Deserialize(payload, decodedTask); err != nil {
 		return nil, TaskWrapper{}, err
 	}
-	decodedTask, _ := tm.types.Load(wrapper.Type)
 
 	return decodedTask, wrapper, nil
 }
 
+func (tm *TaskDispatcher) encodeWrapper(wrapper TaskWrapper) ([]byte, error) {
+	wrapper, err := tm.compress(wrapper)
+	if err != nil {
+		return nil, err
+	}
+	// ciphertext does not compress, so payloads are compressed first.
+	wrapper, err = tm.encrypt(wrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	if tm.envelope {
+		return EncodeEnvelope(wrapper)
+	}
+
+	encoded, err := tm.serializer.Serialize(wrapper)
+	if err != nil {
+		return nil, err
+	}
+	codec := tm.serializer.Codec()
+	if len(codec) > 255 {
+		return nil, serial.ErrSerialization
+	}
+
+	// the codec of the wrapper leads it, behind a zero byte that neither
+	// envelopes nor gob streams start with.
+	data := make([]byte, 0, 2+len(codec)+len(encoded))
+	data = append(data, 0, byte(len(codec)))
+	data = append(data, codec...)
+	return append(data, encoded...), nil
+}
+
+// decodeWrapper decodes a wrapper with the codec leading it, an envelope,
+// or a gob encoded wrapper written before codecs were recorded.
+func (tm *TaskDispatcher) decodeWrapper(data []byte) (TaskWrapper, error) {
+	codec := serial.Gob{}.Codec()
+	if len(data) > 0 && data[0] == 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return TaskWrapper{}, serial.ErrSerialization
+		}
+		codec, data = string(data[2:2+int(data[1])]), data[2+int(data[1]):]
+	} else if wrapper, err := DecodeEnvelope(data); err != ErrNotEnvelope {
+		return wrapper, err
+	}
+
+	serializer, err := tm.codec(codec)
+	if err != nil {
+		return TaskWrapper{}, err
+	}
+	var wrapper TaskWrapper
+	if err := serializer.Deserialize(data, &wrapper); err != nil {
+		return TaskWrapper{}, err
+	}
+
+	return wrapper, nil
+}
+
+// codec returns the serializer of a codec recorded in a wrapper. Wrappers
+// written before codecs were recorded hold gob encoded tasks.
+func (tm *TaskDispatcher) codec(codec string) (serial.Serializer, error) {
+	if codec == "" {
+		codec = serial.Gob{}.Codec()
+	}
+	for _, serializer := range tm.serializers {
+		if serializer.Codec() == codec {
+			return serializer, nil
+		}
+	}
+
+	return nil, serial.ErrUnknownCodec
+}
+
+// compress compresses the payload of a wrapper once it reaches the
+// threshold. Payloads of retried tasks are already compressed or encrypted
+// and kept as is.
+func (tm *TaskDispatcher) compress(wrapper TaskWrapper) (TaskWrapper, error) {
+	if tm.compressor == nil || wrapper.Compression != "" || wrapper.KeyID != "" || len(wrapper.Task) < tm.compressAbove {
+		return wrapper, nil
+	}
+
+	compressed, err := tm.compressor.Compress(wrapper.Task)
+	if err != nil {
+		return TaskWrapper{}, err
+	}
+	if len(compressed) < len(wrapper.Task) {
+		wrapper.Task = compressed
+		wrapper.Compression = tm.compressor.Name()
+	}
+
+	return wrapper, nil
+}
+
+// decompress decompresses a payload with the compressor recorded along with
+// it.
+func (tm *TaskDispatcher) decompress(compression string, payload []byte) ([]byte, error) {
+	if compression == "" {
+		return payload, nil
+	}
+	for _, compressor := range tm.compressors {
+		if compressor.Name() == compression {
+			return compressor.Decompress(payload)
+		}
+	}
+
+	return nil, serial.ErrUnknownCompression
+}
+
+func (tm *TaskDispatcher) appendHistory(report history.TaskReport) {
+	if err := tm.history.Append(context.Background(), report); err != nil {
+		tm.logger.Printf("dispatcher: failed to append %s report of %s: %v", report.Status, report.Type, err)
+	}
+}
+
+// Release stops the background runners and waits for them to push back the
+// tasks they popped but did not start, before releasing the pool and the
+// queue. Tasks already running are not waited for.
 func (tm *TaskDispatcher) Release() {
+	tm.released.Store(true)
 	tm.cancel()
+	tm.runners.Wait()
 	if tm.pool != nil {
 		tm.pool.Release()
 	}
+	if releaser, ok := tm.queue.(tq.Releaser); ok {
+		if err := releaser.Release(); err != nil {
+			tm.logger.Printf("dispatcher: failed to release the queue: %v", err)
+		}
+	}
 }
 
 func isPointer(value any) bool {
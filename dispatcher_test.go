@@ -1,15 +1,20 @@
 package dispatcher_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ZutrixPog/dispatcher"
 	"github.com/ZutrixPog/dispatcher/history"
 	mocks "github.com/ZutrixPog/dispatcher/history/mock"
+	"github.com/ZutrixPog/dispatcher/queue"
 	"github.com/ZutrixPog/dispatcher/queue/mem"
+	serial "github.com/ZutrixPog/dispatcher/serialization"
 	"github.com/stretchr/testify/require"
 )
 
@@ -256,7 +261,7 @@ func TestRemoval(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := manager.Remove(queue, c.taskid)
+		err := manager.Remove(context.Background(), queue, c.taskid)
 		require.Equal(t, c.err, err, c.desc)
 
 		list := manager.RetrivePendingTasks(context.Background(), queue)
@@ -267,6 +272,569 @@ func TestRemoval(t *testing.T) {
 	require.Equal(t, 2, len(hist))
 }
 
+type SagaStepTask struct {
+	Name string
+}
+
+func (st SagaStepTask) Type() string {
+	return "saga-step"
+}
+
+func (st SagaStepTask) Retry() int {
+	return 0
+}
+
+type SagaCompensationTask struct {
+	Name string
+}
+
+func (ct SagaCompensationTask) Type() string {
+	return "saga-compensation"
+}
+
+func (ct SagaCompensationTask) Retry() int {
+	return 0
+}
+
+func TestSaga(t *testing.T) {
+	queue := "saga"
+	manager := initDispatcher()
+
+	var executed []string
+	manager.Task(&SagaStepTask{}, func(ctx context.Context, task any) error {
+		executed = append(executed, task.(*SagaStepTask).Name)
+		return nil
+	})
+	manager.Task(&SagaCompensationTask{}, func(ctx context.Context, task any) error {
+		executed = append(executed, "undo "+task.(*SagaCompensationTask).Name)
+		return nil
+	})
+
+	cases := []struct {
+		desc     string
+		saga     *dispatcher.Saga
+		executed []string
+		status   string
+		err      error
+	}{
+		{
+			desc: "run a successful saga",
+			saga: dispatcher.NewSaga().
+				Step(SagaStepTask{Name: "reserve"}, SagaCompensationTask{Name: "reserve"}).
+				Step(SagaStepTask{Name: "charge"}, SagaCompensationTask{Name: "charge"}),
+			executed: []string{"reserve", "charge"},
+			status:   dispatcher.SagaCompleted,
+			err:      nil,
+		},
+		{
+			desc: "compensate a failed saga in reverse order",
+			saga: dispatcher.NewSaga().
+				Step(SagaStepTask{Name: "reserve"}, SagaCompensationTask{Name: "reserve"}).
+				Step(SagaStepTask{Name: "notify"}, nil).
+				Step(SagaStepTask{Name: "charge"}, SagaCompensationTask{Name: "charge"}).
+				Step(FailingTask{}, SagaCompensationTask{Name: "ship"}),
+			executed: []string{"reserve", "notify", "charge", "undo charge", "undo reserve"},
+			status:   dispatcher.SagaCompensated,
+			err:      nil,
+		},
+		{
+			desc: "abort a saga whose compensation fails",
+			saga: dispatcher.NewSaga().
+				Step(SagaStepTask{Name: "reserve"}, SagaCompensationTask{Name: "reserve"}).
+				Step(SagaStepTask{Name: "charge"}, FailingTask{}).
+				Step(FailingTask{}, nil),
+			executed: []string{"reserve", "charge"},
+			status:   dispatcher.SagaAborted,
+			err:      nil,
+		},
+		{
+			desc:     "spawn an empty saga",
+			saga:     dispatcher.NewSaga(),
+			executed: nil,
+			err:      dispatcher.ErrEmptySaga,
+		},
+		{
+			desc:     "spawn a saga with an unregistered step",
+			saga:     dispatcher.NewSaga().Step(SagaStepTask{Name: "reserve"}, UnregisteredTask{}),
+			executed: nil,
+			err:      dispatcher.ErrUnregisteredTask,
+		},
+	}
+
+	for _, c := range cases {
+		executed = nil
+
+		id, err := manager.SpawnSaga(queue, c.saga)
+		require.Equal(t, c.err, err, c.desc)
+
+		for len(manager.RetrivePendingTasks(context.Background(), queue)) > 0 {
+			manager.Dispatch(context.Background(), queue)
+		}
+		require.Equal(t, c.executed, executed, c.desc)
+		if c.err != nil {
+			continue
+		}
+
+		require.Eventually(t, func() bool {
+			reports := manager.RetrieveTaskHistory(context.Background(), history.Query{Limit: 20, Saga: id, Type: dispatcher.SagaReportType})
+			return len(reports) == 1 && reports[0].Status == c.status
+		}, time.Second, 10*time.Millisecond, c.desc)
+	}
+}
+
+func TestSaga_DeadLetter(t *testing.T) {
+	manager := dispatcher.New(dispatcher.WithQueue(mem.NewQueue(10)), dispatcher.WithDeadLetterQueue("dead"))
+	defer manager.Release()
+	manager.Task(&SagaStepTask{}, func(ctx context.Context, task any) error { return nil })
+	manager.Task(&FailingTask{}, (&FailingExecutor{}).Execute)
+
+	_, err := manager.SpawnSaga("saga", dispatcher.NewSaga().
+		Step(SagaStepTask{Name: "charge"}, FailingTask{}).
+		Step(FailingTask{}, nil))
+	require.Nil(t, err)
+
+	for len(manager.RetrivePendingTasks(context.Background(), "saga")) > 0 {
+		manager.Dispatch(context.Background(), "saga")
+	}
+
+	dead := manager.RetrivePendingTasks(context.Background(), "dead")
+	require.Equal(t, 1, len(dead), "the failed compensation is dead lettered, not the failed step")
+	require.Equal(t, FailingTask{}.Type(), dead[0].Type)
+}
+
+// requeueFailingQueue fails to requeue tasks, like a backend that went
+// away between popping a task and queueing the next one.
+type requeueFailingQueue struct {
+	queue.TaskQueue
+}
+
+func (q requeueFailingQueue) Requeue(ctx context.Context, name string, task queue.Message) error {
+	return queue.ErrCreateEntity
+}
+
+func TestSaga_RequeueFailure(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	manager := dispatcher.New(
+		dispatcher.WithQueue(requeueFailingQueue{mem.NewQueue(10)}),
+		dispatcher.WithHistory(mocks.NewMockHistoryRepo()),
+		dispatcher.WithClock(func() time.Time { return start }),
+	)
+	defer manager.Release()
+	manager.Task(&SagaStepTask{}, func(ctx context.Context, task any) error { return nil })
+
+	id, err := manager.SpawnSaga("saga", dispatcher.NewSaga().
+		Step(SagaStepTask{Name: "reserve"}, nil).
+		Step(SagaStepTask{Name: "charge"}, nil))
+	require.Nil(t, err)
+	require.Nil(t, manager.Dispatch(context.Background(), "saga"))
+
+	var reports []history.TaskReport
+	require.Eventually(t, func() bool {
+		reports = manager.RetrieveTaskHistory(context.Background(), history.Query{Limit: 10, Saga: id, Type: dispatcher.SagaReportType})
+		return len(reports) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, dispatcher.SagaAborted, reports[0].Status, "a saga whose next step can not be queued is aborted")
+	require.Equal(t, start, reports[0].Submitted)
+	require.Equal(t, start, reports[0].CreatedAt)
+}
+
+type UnregisteredTask struct{}
+
+func (ut UnregisteredTask) Type() string {
+	return "unregistered"
+}
+
+func (ut UnregisteredTask) Retry() int {
+	return 0
+}
+
+type UrgentTask struct{}
+
+func (ut UrgentTask) Type() string {
+	return "urgent"
+}
+
+func (ut UrgentTask) Retry() int {
+	return 0
+}
+
+func (ut UrgentTask) Priority() int {
+	return 10
+}
+
+func TestPriority(t *testing.T) {
+	queue := "priority"
+	manager := initDispatcher()
+	manager.Task(&UrgentTask{}, func(ctx context.Context, task any) error {
+		return nil
+	})
+
+	cases := []struct {
+		desc  string
+		task  dispatcher.Task
+		opts  []dispatcher.SpawnOption
+		index int
+	}{
+		{
+			desc:  "spawn a task with the default priority",
+			task:  DummyTask{Msg: "default"},
+			index: 0,
+		},
+		{
+			desc:  "spawn a task with a priority option",
+			task:  DummyTask2{Msg: "option"},
+			opts:  []dispatcher.SpawnOption{dispatcher.WithPriority(5)},
+			index: 0,
+		},
+		{
+			desc:  "spawn a task implementing PriorityTask",
+			task:  UrgentTask{},
+			index: 0,
+		},
+		{
+			desc:  "spawn a task with a priority option overriding PriorityTask",
+			task:  LongDummyTask{Msg: "override"},
+			opts:  []dispatcher.SpawnOption{dispatcher.WithPriority(-1)},
+			index: 3,
+		},
+	}
+
+	for _, c := range cases {
+		index, err := manager.Spawn(queue, c.task, c.opts...)
+		require.Nil(t, err, c.desc)
+		require.Equal(t, c.index, index, c.desc)
+	}
+
+	pending := manager.RetrivePendingTasks(context.Background(), queue)
+	require.Equal(t, 4, len(pending))
+	for i, expected := range []struct {
+		typ      string
+		priority int
+	}{{"urgent", 10}, {"dummy2", 5}, {"dummy", 0}, {"longdummy", -1}} {
+		require.Equal(t, expected.typ, pending[i].Type)
+		require.Equal(t, expected.priority, pending[i].Priority)
+	}
+
+	require.Nil(t, manager.Dispatch(context.Background(), queue))
+	pending = manager.RetrivePendingTasks(context.Background(), queue)
+	require.Equal(t, 3, len(pending))
+	require.Equal(t, "dummy2", pending[0].Type)
+}
+
+type CountedTask struct {
+	Queue string
+}
+
+func (ct CountedTask) Type() string {
+	return "counted"
+}
+
+func (ct CountedTask) Retry() int {
+	return 0
+}
+
+func TestWeightedQueues(t *testing.T) {
+	queues := []dispatcher.WeightedQueue{{Name: "critical", Weight: 6}, {Name: "default", Weight: 3}, {Name: "low", Weight: 1}}
+	manager := dispatcher.Init(mem.NewQueue(100), mocks.NewMockHistoryRepo(), 5, queues...)
+	defer manager.Release()
+
+	executed := make(chan string, 100)
+	manager.Task(&LongDummyTask{}, func(ctx context.Context, task any) error {
+		return nil
+	})
+	manager.Task(&CountedTask{}, func(ctx context.Context, task any) error {
+		executed <- task.(*CountedTask).Queue
+		return nil
+	})
+
+	cases := []struct {
+		desc  string
+		queue string
+		tasks int
+	}{
+		{
+			desc:  "consume a heavily weighted queue",
+			queue: "critical",
+			tasks: 12,
+		},
+		{
+			desc:  "consume a queue with a medium weight",
+			queue: "default",
+			tasks: 6,
+		},
+		{
+			desc:  "consume a lightly weighted queue",
+			queue: "low",
+			tasks: 2,
+		},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < c.tasks; i++ {
+			_, err := manager.Spawn(c.queue, CountedTask{Queue: c.queue})
+			require.Nil(t, err, c.desc)
+		}
+	}
+
+	_, err := manager.SpawnBg(LongDummyTask{})
+	require.Nil(t, err)
+
+	counts := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		select {
+		case queue := <-executed:
+			counts[queue]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of 20 tasks were executed", i)
+		}
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.tasks, counts[c.queue], c.desc)
+	}
+	require.Equal(t, 1, len(manager.RetrivePendingTasks(context.Background(), dispatcher.BgQueue)), "queues that are not consumed stay pending")
+}
+
+type recordingLogger struct {
+	lines chan string
+}
+
+func (l *recordingLogger) Printf(format string, v ...any) {
+	l.lines <- fmt.Sprintf(format, v...)
+}
+
+func TestOptions(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	logger := &recordingLogger{lines: make(chan string, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	manager := dispatcher.New(
+		dispatcher.WithQueue(mem.NewQueue(10)),
+		dispatcher.WithHistory(mocks.NewMockHistoryRepo()),
+		dispatcher.WithWorkers(2),
+		dispatcher.WithWorkerTimeout(time.Second),
+		dispatcher.WithProducers(1),
+		dispatcher.WithBgQueue("jobs"),
+		dispatcher.WithLogger(logger),
+		dispatcher.WithClock(func() time.Time { return now }),
+		dispatcher.WithIDGenerator(func() string { return "saga-1" }),
+		dispatcher.WithContext(ctx),
+	)
+	defer manager.Release()
+
+	f := &FailingExecutor{}
+	manager.Task(&FailingTask{}, f.Execute)
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		return nil
+	})
+
+	_, err := manager.Spawn("queue", DummyTask{})
+	require.Nil(t, err)
+	pending := manager.RetrivePendingTasks(context.Background(), "queue")
+	require.Equal(t, now, pending[0].Submitted, "submission time comes from the clock")
+
+	id, err := manager.SpawnSaga("queue", dispatcher.NewSaga().Step(DummyTask{}, nil))
+	require.Nil(t, err)
+	require.Equal(t, "saga-1", id, "saga IDs come from the generator")
+
+	_, err = manager.SpawnBg(FailingTask{})
+	require.Nil(t, err)
+	select {
+	case line := <-logger.lines:
+		require.Contains(t, line, "jobs", "background tasks run from the configured queue")
+		require.Contains(t, line, dispatcher.ErrEmptyID.Error(), "background failures are logged")
+	case <-time.After(5 * time.Second):
+		t.Fatal("background task was not executed")
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	_, err = manager.SpawnBg(FailingTask{})
+	require.Nil(t, err)
+	select {
+	case line := <-logger.lines:
+		t.Fatalf("background task executed after the parent context was cancelled: %s", line)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPauseQueue(t *testing.T) {
+	queue := "paused"
+	manager := initDispatcher()
+
+	_, err := manager.Spawn(queue, DummyTask{Msg: "hey"})
+	require.Nil(t, err)
+	require.Nil(t, manager.PauseQueue(context.Background(), queue))
+
+	_, err = manager.Spawn(queue, DummyTask2{Msg: "hola"})
+	require.Nil(t, err, "tasks can be spawned to a paused queue")
+
+	pending := manager.RetrivePendingTasks(context.Background(), queue)
+	require.Equal(t, 2, len(pending))
+	require.Equal(t, "paused", pending[0].Status)
+
+	require.Equal(t, dispatcher.ErrQueuePaused, manager.Dispatch(context.Background(), queue))
+	require.Equal(t, dispatcher.ErrQueuePaused, manager.DispatchFilter(context.Background(), queue, &DummyTask2{}))
+	manager.DispatchAll(context.Background(), queue)
+	require.Equal(t, 2, len(manager.RetrivePendingTasks(context.Background(), queue)))
+
+	require.Nil(t, manager.PauseQueue(context.Background(), dispatcher.BgQueue))
+	_, err = manager.SpawnBg(LongDummyTask{Msg: "paused"})
+	require.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, len(manager.RetrivePendingTasks(context.Background(), dispatcher.BgQueue)), "runners skip paused queues")
+
+	require.Nil(t, manager.ResumeQueue(context.Background(), queue))
+	pending = manager.RetrivePendingTasks(context.Background(), queue)
+	require.Equal(t, "pending", pending[0].Status)
+
+	manager.DispatchAll(context.Background(), queue)
+	require.Equal(t, 0, len(manager.RetrivePendingTasks(context.Background(), queue)))
+}
+
+func TestQueueMaintenance(t *testing.T) {
+	repo := mocks.NewMockHistoryRepo()
+	manager := dispatcher.New(dispatcher.WithQueue(mem.NewQueue(10)), dispatcher.WithHistory(repo))
+	defer manager.Release()
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error { return nil })
+	manager.Task(&DummyTask2{}, func(ctx context.Context, task any) error { return nil })
+	manager.Task(&LongDummyTask{}, func(ctx context.Context, task any) error { return nil })
+
+	_, err := manager.Spawn("maintenance", DummyTask{}, dispatcher.WithHeader("tenant", "acme"))
+	require.Nil(t, err)
+	_, err = manager.Spawn("maintenance", DummyTask2{}, dispatcher.WithHeader("tenant", "other"))
+	require.Nil(t, err)
+	_, err = manager.Spawn("maintenance", LongDummyTask{}, dispatcher.WithHeader("tenant", "acme"))
+	require.Nil(t, err)
+
+	moved, err := manager.MoveTasks(context.Background(), "maintenance", "acme", queue.Filter{Headers: map[string]string{"tenant": "acme"}})
+	require.Nil(t, err)
+	require.Equal(t, 2, moved)
+	require.Equal(t, 1, len(manager.RetrivePendingTasks(context.Background(), "maintenance")))
+	require.Equal(t, 2, len(manager.RetrivePendingTasks(context.Background(), "acme")))
+
+	deleted, err := manager.DeleteTasks(context.Background(), "acme", queue.Filter{Type: DummyTask{}.Type()})
+	require.Nil(t, err)
+	require.Equal(t, 1, deleted)
+	pending := manager.RetrivePendingTasks(context.Background(), "acme")
+	require.Equal(t, 1, len(pending))
+	require.Equal(t, LongDummyTask{}.Type(), pending[0].Type)
+
+	purged, err := manager.PurgeQueue(context.Background(), "maintenance")
+	require.Nil(t, err)
+	require.Equal(t, 1, purged)
+	require.Equal(t, 0, len(manager.RetrivePendingTasks(context.Background(), "maintenance")))
+
+	reports, _ := repo.Retrieve(context.Background(), history.Query{Limit: 10, Status: "moved"})
+	require.Equal(t, 2, len(reports))
+	require.Equal(t, "maintenance", reports[0].Queue, "moved tasks are reported in their source queue")
+
+	reports, _ = repo.Retrieve(context.Background(), history.Query{Limit: 10, Status: "removed"})
+	require.Equal(t, 2, len(reports))
+	require.Equal(t, "maintenance", reports[0].Queue)
+	require.Equal(t, DummyTask2{}.Type(), reports[0].Type)
+	require.Equal(t, "acme", reports[1].Queue)
+	require.Equal(t, DummyTask{}.Type(), reports[1].Type)
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	manager := dispatcher.New(dispatcher.WithQueue(mem.NewQueue(10)), dispatcher.WithDeadLetterQueue("dead"))
+	defer manager.Release()
+
+	failing := true
+	manager.Task(&RetryingTask{}, func(ctx context.Context, task any) error {
+		if failing {
+			return dispatcher.ErrEmptyID
+		}
+		return nil
+	})
+	manager.Task(&SagaStepTask{}, func(ctx context.Context, task any) error {
+		return dispatcher.ErrEmptyID
+	})
+
+	_, err := manager.Spawn("payments", RetryingTask{}, dispatcher.WithHeader("tenant", "acme"))
+	require.Nil(t, err)
+	require.Nil(t, manager.Dispatch(context.Background(), "payments"))
+	require.Equal(t, 0, len(manager.RetrivePendingTasks(context.Background(), "dead")), "tasks with retries left are retried")
+	require.Equal(t, dispatcher.ErrEmptyID, manager.Dispatch(context.Background(), "payments"))
+	require.Equal(t, 1, len(manager.RetrivePendingTasks(context.Background(), "dead")), "failed tasks are dead lettered")
+
+	_, err = manager.SpawnSaga("payments", dispatcher.NewSaga().Step(SagaStepTask{}, nil))
+	require.Nil(t, err)
+	require.Equal(t, dispatcher.ErrEmptyID, manager.Dispatch(context.Background(), "payments"))
+	require.Equal(t, 1, len(manager.RetrivePendingTasks(context.Background(), "dead")), "saga steps are compensated instead")
+
+	moved, err := manager.MoveTasks(context.Background(), "dead", "payments", queue.Filter{Headers: map[string]string{
+		dispatcher.OriginQueueHeader: "payments",
+		"tenant":                     "acme",
+	}})
+	require.Nil(t, err)
+	require.Equal(t, 1, moved)
+
+	failing = false
+	require.Nil(t, manager.Dispatch(context.Background(), "payments"), "moved tasks can be dispatched again")
+	require.Equal(t, 0, len(manager.RetrivePendingTasks(context.Background(), "payments")))
+}
+
+func TestQueueStats(t *testing.T) {
+	manager := initDispatcher()
+
+	_, err := manager.Spawn("stats", DummyTask{})
+	require.Nil(t, err)
+	_, err = manager.Spawn("stats", DummyTask2{})
+	require.Nil(t, err)
+	require.Nil(t, manager.Dispatch(context.Background(), "stats"))
+
+	queues, err := manager.ListQueues(context.Background())
+	require.Nil(t, err)
+	require.Contains(t, queues, "stats")
+
+	stats, err := manager.QueueStats(context.Background(), "stats")
+	require.Nil(t, err)
+	require.Equal(t, 1, stats.Length)
+	require.Equal(t, int64(2), stats.Enqueued)
+	require.Equal(t, int64(1), stats.Dequeued)
+	require.False(t, stats.Oldest.IsZero())
+}
+
+func TestSpawnWith(t *testing.T) {
+	manager := initDispatcher()
+	outbox := mem.NewQueue(10)
+
+	_, err := manager.SpawnWith(outbox, "outbox", DummyTask{Msg: "hey"}, dispatcher.WithHeader("tenant", "acme"))
+	require.Nil(t, err)
+
+	stats, err := manager.QueueStats(context.Background(), "outbox")
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.Length, "the task is handed to the pusher only")
+
+	task, err := outbox.Pop(context.Background(), "outbox")
+	require.Nil(t, err)
+	require.Equal(t, "dummy", task.Type)
+	require.Equal(t, map[string]string{"tenant": "acme"}, task.Headers)
+
+	_, err = manager.SpawnWith(outbox, "outbox", UnregisteredTask{})
+	require.ErrorIs(t, err, dispatcher.ErrUnregisteredTask)
+}
+
+func TestReleaseQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.json")
+	list, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path}, 10)
+	require.Nil(t, err)
+	manager := dispatcher.New(dispatcher.WithQueue(list))
+	manager.Task(&DummyTask{}, (&DummyExecutor{}).Execute)
+
+	_, err = manager.Spawn("snapshot", DummyTask{Msg: "hey"})
+	require.Nil(t, err)
+	manager.Release()
+
+	restored, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path}, 10)
+	require.Nil(t, err)
+	task, err := restored.Pop(context.Background(), "snapshot")
+	require.Nil(t, err, "releasing the dispatcher saves the queue")
+	require.Equal(t, "dummy", task.Type)
+}
+
 func initDispatcher() dispatcher.Dispatcher {
 	list := mem.NewQueue(10)
 	history := mocks.NewMockHistoryRepo()
@@ -294,3 +862,344 @@ func initDispatcher() dispatcher.Dispatcher {
 
 	return manager
 }
+
+func TestReleasePrefetched(t *testing.T) {
+	list := mem.NewQueue(10)
+	manager := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithWorkers(1))
+
+	started, unblock := make(chan struct{}, 3), make(chan struct{})
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		started <- struct{}{}
+		<-unblock
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		_, err := manager.SpawnBg(DummyTask{Msg: fmt.Sprint(i)})
+		require.Nil(t, err)
+	}
+
+	<-started
+	time.Sleep(100 * time.Millisecond)
+	manager.Release()
+	close(unblock)
+
+	require.Eventually(t, func() bool {
+		stats, err := list.QueueStats(context.Background(), dispatcher.BgQueue)
+		return err == nil && stats.Length == 2
+	}, time.Second, 10*time.Millisecond, "tasks popped but not started are pushed back on release")
+	require.Len(t, started, 0)
+}
+
+func TestPrefetchBound(t *testing.T) {
+	list := mem.NewQueue(20)
+	manager := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithWorkers(4), dispatcher.WithProducers(2))
+	defer manager.Release()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		<-unblock
+		return nil
+	})
+	for i := 0; i < 10; i++ {
+		_, err := manager.SpawnBg(DummyTask{Msg: fmt.Sprint(i)})
+		require.Nil(t, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	stats, err := list.QueueStats(context.Background(), dispatcher.BgQueue)
+	require.Nil(t, err)
+	require.Equal(t, 6, stats.Length, "the runners pop no more tasks ahead than the pool runs")
+}
+
+func TestReleasePrefetched_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.json")
+	list, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path}, 10)
+	require.Nil(t, err)
+	manager := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithWorkers(1))
+
+	started, unblock := make(chan struct{}, 3), make(chan struct{})
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		started <- struct{}{}
+		<-unblock
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		_, err := manager.SpawnBg(DummyTask{Msg: fmt.Sprint(i)})
+		require.Nil(t, err)
+	}
+
+	<-started
+	time.Sleep(100 * time.Millisecond)
+	manager.Release()
+	close(unblock)
+
+	restored, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path}, 10)
+	require.Nil(t, err)
+	stats, err := restored.QueueStats(context.Background(), dispatcher.BgQueue)
+	require.Nil(t, err)
+	require.Equal(t, 2, stats.Length, "tasks popped but not started are pushed back before the queue is saved")
+}
+
+// contextQueue fails pushes once their context is done, like the backends
+// going over the network.
+type contextQueue struct {
+	queue.TaskQueue
+}
+
+func (q contextQueue) Push(ctx context.Context, name string, task queue.Message) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return q.TaskQueue.Push(ctx, name, task)
+}
+
+func TestReleaseRetrying(t *testing.T) {
+	list := mem.NewQueue(10)
+	manager := dispatcher.New(dispatcher.WithQueue(contextQueue{list}), dispatcher.WithWorkers(1))
+
+	started := make(chan struct{}, 1)
+	manager.Task(&RetryingTask{}, func(ctx context.Context, task any) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	_, err := manager.SpawnBg(RetryingTask{})
+	require.Nil(t, err)
+
+	<-started
+	manager.Release()
+
+	require.Eventually(t, func() bool {
+		stats, err := list.QueueStats(context.Background(), dispatcher.BgQueue)
+		return err == nil && stats.Length == 1
+	}, time.Second, 10*time.Millisecond, "a task failing while the dispatcher shuts down is queued again to be retried")
+}
+
+func TestListPendingTasks(t *testing.T) {
+	manager := dispatcher.New(dispatcher.WithQueue(mem.NewQueue(10)))
+	defer manager.Release()
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error { return nil })
+	manager.Task(&DummyTask2{}, func(ctx context.Context, task any) error { return nil })
+	manager.Task(&LongDummyTask{}, func(ctx context.Context, task any) error { return nil })
+
+	for _, task := range []dispatcher.Task{DummyTask{}, DummyTask2{}, LongDummyTask{}} {
+		_, err := manager.Spawn("listing", task)
+		require.Nil(t, err)
+	}
+
+	pending, err := manager.ListPendingTasks(context.Background(), "listing", queue.Page{Offset: 1, Limit: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(pending))
+	require.Equal(t, uint(1), pending[0].ID, "reports of unfiltered pages are indexed in the queue")
+	require.Equal(t, DummyTask2{}.Type(), pending[0].Type)
+
+	pending, err = manager.ListPendingTasks(context.Background(), "listing", queue.Page{Filter: queue.Filter{Type: LongDummyTask{}.Type()}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(pending))
+	require.Equal(t, LongDummyTask{}.Type(), pending[0].Type)
+
+	pending, err = manager.ListPendingTasks(context.Background(), "empty", queue.Page{})
+	require.Nil(t, err)
+	require.Empty(t, pending)
+}
+
+func TestMixedCodecs(t *testing.T) {
+	list := mem.NewQueue(10)
+	reader := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithSerializer(serial.JSON{}))
+	defer reader.Release()
+
+	var received []string
+	reader.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		received = append(received, task.(*DummyTask).Msg)
+		return nil
+	})
+
+	serializers := []serial.Serializer{serial.Gob{}, serial.JSON{}, serial.MsgPack{}}
+	for _, serializer := range serializers {
+		writer := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithSerializer(serializer))
+		writer.Task(&DummyTask{}, (&DummyExecutor{}).Execute)
+		_, err := writer.Spawn("mixed", DummyTask{Msg: serializer.Codec()})
+		require.Nil(t, err, serializer.Codec())
+		writer.Release()
+
+		pending := reader.RetrivePendingTasks(context.Background(), "mixed")
+		require.Equal(t, 1, len(pending), serializer.Codec())
+		require.Equal(t, DummyTask{}.Type(), pending[0].Type)
+		require.Nil(t, reader.Dispatch(context.Background(), "mixed"), serializer.Codec())
+	}
+	require.Equal(t, []string{"gob", "json", "msgpack"}, received, "tasks of every built-in codec are read")
+}
+
+func TestRecordedCodec(t *testing.T) {
+	list := mem.NewQueue(10)
+	manager := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithSerializer(serial.JSON{}))
+	defer manager.Release()
+	manager.Task(&DummyTask{}, (&DummyExecutor{}).Execute)
+
+	_, err := manager.Spawn("codec", DummyTask{Msg: "json"})
+	require.Nil(t, err)
+	tasks, err := list.List(context.Background(), "codec", queue.Page{})
+	require.Nil(t, err)
+	require.True(t, bytes.HasPrefix(tasks[0].Data, []byte("\x00\x04json")), "the codec leads the encoded wrapper")
+	require.Nil(t, manager.Dispatch(context.Background(), "codec"))
+
+	task, err := serial.Gob{}.Serialize(DummyTask{Msg: "legacy"})
+	require.Nil(t, err)
+	legacy, err := serial.Gob{}.Serialize(dispatcher.TaskWrapper{Type: DummyTask{}.Type(), Task: task})
+	require.Nil(t, err)
+	_, err = list.Push(context.Background(), "codec", queue.Message{Data: legacy})
+	require.Nil(t, err)
+	require.Nil(t, manager.Dispatch(context.Background(), "codec"), "wrappers without a codec are read as gob")
+
+	unknown := append([]byte("\x00\x04yaml"), tasks[0].Data[6:]...)
+	_, err = list.Push(context.Background(), "codec", queue.Message{Data: unknown})
+	require.Nil(t, err)
+	require.Equal(t, serial.ErrUnknownCodec, manager.Dispatch(context.Background(), "codec"), "the recorded codec is the only one tried")
+}
+
+func TestCompression(t *testing.T) {
+	list := mem.NewQueue(10)
+	reader := dispatcher.New(dispatcher.WithQueue(list))
+	defer reader.Release()
+
+	var received []string
+	reader.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		received = append(received, task.(*DummyTask).Msg)
+		return nil
+	})
+
+	large := strings.Repeat("compressible ", 20)
+	for _, compressor := range serial.BuiltinCompressors() {
+		writer := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithSerializer(serial.JSON{}), dispatcher.WithEnvelope(), dispatcher.WithCompression(compressor, 64))
+		writer.Task(&DummyTask{}, (&DummyExecutor{}).Execute)
+
+		for _, msg := range []string{"small", large} {
+			_, err := writer.Spawn("compressed", DummyTask{Msg: msg})
+			require.Nil(t, err)
+
+			tasks, err := list.List(context.Background(), "compressed", queue.Page{Limit: 1})
+			require.Nil(t, err)
+			wrapper, err := dispatcher.DecodeEnvelope(tasks[0].Data)
+			require.Nil(t, err)
+			if msg == large {
+				require.Equal(t, compressor.Name(), wrapper.Compression, "payloads above the threshold are compressed")
+			} else {
+				require.Empty(t, wrapper.Compression, "payloads below the threshold are kept as is")
+			}
+
+			require.Nil(t, reader.Dispatch(context.Background(), "compressed"), compressor.Name())
+		}
+		writer.Release()
+	}
+	require.Equal(t, []string{"small", large, "small", large}, received, "consumers decompress tasks without being configured to")
+}
+
+func TestCompression_MaxSize(t *testing.T) {
+	for _, compressor := range []serial.Compressor{serial.Gzip{MaxSize: 16}, serial.Snappy{MaxSize: 16}} {
+		for _, size := range []int{16, 17} {
+			compressed, err := compressor.Compress(bytes.Repeat([]byte("a"), size))
+			require.Nil(t, err)
+
+			data, err := compressor.Decompress(compressed)
+			if size > 16 {
+				require.Equal(t, serial.ErrTooLarge, err, "%s does not decompress payloads above the maximum", compressor.Name())
+				continue
+			}
+			require.Nil(t, err, compressor.Name())
+			require.Len(t, data, size, compressor.Name())
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	list := mem.NewQueue(10)
+	keys := dispatcher.StaticKeys{Current: "old", Keys: map[string][]byte{
+		"old": []byte("0123456789abcdef"),
+		"new": []byte("fedcba9876543210fedcba9876543210"),
+	}}
+
+	writer := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithEnvelope(), dispatcher.WithCompression(serial.Gzip{}, 0), dispatcher.WithEncryption(keys))
+	writer.Task(&DummyTask{}, (&DummyExecutor{}).Execute)
+	_, err := writer.Spawn("encrypted", DummyTask{Msg: "before rotation"})
+	require.Nil(t, err)
+	writer.Release()
+
+	// the new key is rotated in, the old one is kept for the queued tasks.
+	keys.Current = "new"
+	reader := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithEnvelope(), dispatcher.WithEncryption(keys))
+	defer reader.Release()
+
+	var received []string
+	reader.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		received = append(received, task.(*DummyTask).Msg)
+		return nil
+	})
+	_, err = reader.Spawn("rotated", DummyTask{Msg: "after rotation"})
+	require.Nil(t, err)
+
+	for queueName, keyID := range map[string]string{"encrypted": "old", "rotated": "new"} {
+		tasks, err := list.List(context.Background(), queueName, queue.Page{Limit: 1})
+		require.Nil(t, err)
+		wrapper, err := dispatcher.DecodeEnvelope(tasks[0].Data)
+		require.Nil(t, err)
+		require.Equal(t, keyID, wrapper.KeyID, queueName)
+		require.NotContains(t, string(tasks[0].Data), "rotation", "payloads are not readable at rest")
+	}
+
+	require.Nil(t, reader.Dispatch(context.Background(), "encrypted"))
+	require.Nil(t, reader.Dispatch(context.Background(), "rotated"))
+	require.Equal(t, []string{"before rotation", "after rotation"}, received, "tasks of rotated keys stay readable")
+
+	_, err = reader.Spawn("lost", DummyTask{Msg: "lost key"})
+	require.Nil(t, err)
+	plain := dispatcher.New(dispatcher.WithQueue(list))
+	defer plain.Release()
+	plain.Task(&DummyTask{}, (&DummyExecutor{}).Execute)
+	require.ErrorIs(t, plain.Dispatch(context.Background(), "lost"), dispatcher.ErrUnknownKey, "tasks can not be read without their key")
+}
+
+func TestEncryption_Saga(t *testing.T) {
+	keys := dispatcher.StaticKeys{Current: "key", Keys: map[string][]byte{"key": []byte("0123456789abcdef")}}
+	manager := dispatcher.New(dispatcher.WithEncryption(keys))
+	defer manager.Release()
+
+	var executed []string
+	manager.Task(&SagaStepTask{}, func(ctx context.Context, task any) error {
+		executed = append(executed, task.(*SagaStepTask).Name)
+		return nil
+	})
+	manager.Task(&SagaCompensationTask{}, func(ctx context.Context, task any) error {
+		executed = append(executed, "undo "+task.(*SagaCompensationTask).Name)
+		return nil
+	})
+	manager.Task(&FailingTask{}, (&FailingExecutor{}).Execute)
+
+	_, err := manager.SpawnSaga("saga", dispatcher.NewSaga().
+		Step(SagaStepTask{Name: "reserve"}, SagaCompensationTask{Name: "reserve"}).
+		Step(FailingTask{}, nil))
+	require.Nil(t, err)
+	for len(manager.RetrivePendingTasks(context.Background(), "saga")) > 0 {
+		manager.Dispatch(context.Background(), "saga")
+	}
+	require.Equal(t, []string{"reserve", "undo reserve"}, executed, "the encrypted steps and compensations of a saga are run")
+}
+
+func TestReleaseTwice(t *testing.T) {
+	manager := dispatcher.New(dispatcher.WithQueue(mem.NewQueue(10)))
+
+	manager.Release()
+	require.NotPanics(t, manager.Release, "releasing a released dispatcher does nothing")
+}
+
+func TestSpawnReleased(t *testing.T) {
+	manager := dispatcher.New(dispatcher.WithQueue(mem.NewQueue(10)))
+	manager.Task(&SagaStepTask{}, func(ctx context.Context, task any) error { return nil })
+	manager.Release()
+
+	_, err := manager.Spawn("released", SagaStepTask{Name: "reserve"})
+	require.Equal(t, dispatcher.ErrDispatcherClosed, err)
+	_, err = manager.SpawnSaga("released", dispatcher.NewSaga().Step(SagaStepTask{Name: "reserve"}, nil))
+	require.Equal(t, dispatcher.ErrDispatcherClosed, err)
+}
@@ -0,0 +1,126 @@
+package dispatcher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// KeyProvider supplies the AES keys task payloads are encrypted with. Keys
+// are 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key new tasks are encrypted with and its ID,
+	// which is recorded along with every task encrypted with it.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key of an ID recorded in a task. It returns
+	// ErrUnknownKey for keys it does not hold.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory. New tasks are
+// encrypted with the key named by Current; a key is rotated by adding the
+// new one and naming it Current, keeping the old one until the tasks
+// encrypted with it are gone.
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return k.Current, key, nil
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+// encrypt encrypts the payload of a wrapper with the current key. Payloads
+// of retried tasks and saga steps are already encrypted and kept as is.
+func (tm *TaskDispatcher) encrypt(wrapper TaskWrapper) (TaskWrapper, error) {
+	if tm.keys == nil || wrapper.KeyID != "" {
+		return wrapper, nil
+	}
+
+	keyID, key, err := tm.keys.CurrentKey()
+	if err != nil {
+		return TaskWrapper{}, err
+	}
+	sealed, err := seal(key, wrapper.Type, wrapper.Task)
+	if err != nil {
+		return TaskWrapper{}, err
+	}
+	wrapper.Task = sealed
+	wrapper.KeyID = keyID
+
+	return wrapper, nil
+}
+
+// decrypt returns the payload of a wrapper, decrypted with the key recorded
+// in it.
+func (tm *TaskDispatcher) decrypt(wrapper TaskWrapper) ([]byte, error) {
+	if wrapper.KeyID == "" {
+		return wrapper.Task, nil
+	}
+	if tm.keys == nil {
+		return nil, ErrUnknownKey
+	}
+
+	key, err := tm.keys.Key(wrapper.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapper.Task) < aead.NonceSize() {
+		return nil, ErrDecryption
+	}
+
+	nonce, sealed := wrapper.Task[:aead.NonceSize()], wrapper.Task[aead.NonceSize():]
+	task, err := aead.Open(nil, nonce, sealed, []byte(wrapper.Type))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return task, nil
+}
+
+// seal encrypts a task of the given type. The random nonce is prepended to
+// the ciphertext and the type is authenticated along with it, so a payload
+// can not be passed off as a task of another type.
+func seal(key []byte, taskType string, task []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(task)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, ErrEncryption
+	}
+
+	return aead.Seal(nonce, nonce, task, []byte(taskType)), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrEncryption
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ErrEncryption
+	}
+
+	return aead, nil
+}
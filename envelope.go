@@ -0,0 +1,130 @@
+package dispatcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	serial "github.com/ZutrixPog/dispatcher/serialization"
+)
+
+// EnvelopeVersion is the version of the envelope format EncodeEnvelope
+// writes. Envelopes of later versions are rejected, since their fields may
+// change how a task has to be run.
+const EnvelopeVersion = 1
+
+// envelope is the language-neutral JSON form of a TaskWrapper documented in
+// the readme. Fields are only ever added within a version.
+type envelope struct {
+	Version     int               `json:"version"`
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Codec       string            `json:"codec"`
+	Compression string            `json:"compression,omitempty"`
+	KeyID       string            `json:"keyId,omitempty"`
+	Payload     json.RawMessage   `json:"payload"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Priority    int               `json:"priority"`
+	Attempts    int               `json:"attempts"`
+	Retries     int               `json:"retries"`
+	Submitted   time.Time         `json:"submitted"`
+	Saga        *SagaState        `json:"saga,omitempty"`
+}
+
+// EncodeEnvelope writes a wrapper in the envelope format, with timestamps in
+// UTC. The payload of a task written with the JSON codec is embedded as is,
+// and the payload of any other codec or a compressed or encrypted one as a
+// base64 string.
+func EncodeEnvelope(wrapper TaskWrapper) ([]byte, error) {
+	payload, err := encodePayload(embedded(wrapper.Codec, wrapper.Compression, wrapper.KeyID), wrapper.Task)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(envelope{
+		Version:     EnvelopeVersion,
+		ID:          wrapper.ID,
+		Type:        wrapper.Type,
+		Codec:       wrapper.Codec,
+		Compression: wrapper.Compression,
+		KeyID:       wrapper.KeyID,
+		Payload:     payload,
+		Headers:     wrapper.Headers,
+		Priority:    wrapper.Priority,
+		Attempts:    wrapper.Attempts,
+		Retries:     wrapper.Retries,
+		Submitted:   wrapper.Submitted.UTC(),
+		Saga:        wrapper.Saga,
+	})
+	if err != nil {
+		return nil, serial.ErrSerialization
+	}
+
+	return data, nil
+}
+
+// DecodeEnvelope reads a wrapper written in the envelope format. It returns
+// ErrNotEnvelope for data in any other format and ErrEnvelopeVersion for
+// envelopes of later versions.
+func DecodeEnvelope(data []byte) (TaskWrapper, error) {
+	var env envelope
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) || json.Unmarshal(data, &env) != nil || env.Version == 0 {
+		return TaskWrapper{}, ErrNotEnvelope
+	}
+	if env.Version > EnvelopeVersion {
+		return TaskWrapper{}, ErrEnvelopeVersion
+	}
+
+	task, err := decodePayload(embedded(env.Codec, env.Compression, env.KeyID), env.Payload)
+	if err != nil {
+		return TaskWrapper{}, err
+	}
+
+	return TaskWrapper{
+		ID:          env.ID,
+		Type:        env.Type,
+		Codec:       env.Codec,
+		Compression: env.Compression,
+		KeyID:       env.KeyID,
+		Submitted:   env.Submitted,
+		Task:        task,
+		Retries:     env.Retries,
+		Attempts:    env.Attempts,
+		Priority:    env.Priority,
+		Headers:     env.Headers,
+		Saga:        env.Saga,
+	}, nil
+}
+
+// embedded reports whether a payload is embedded as is, which only JSON
+// left uncompressed and unencrypted can be.
+func embedded(codec, compression, keyID string) bool {
+	return codec == (serial.JSON{}).Codec() && compression == "" && keyID == ""
+}
+
+func encodePayload(embed bool, task []byte) (json.RawMessage, error) {
+	if embed {
+		if !json.Valid(task) {
+			return nil, serial.ErrSerialization
+		}
+		return task, nil
+	}
+
+	data, err := json.Marshal(task)
+	if err != nil {
+		return nil, serial.ErrSerialization
+	}
+	return data, nil
+}
+
+func decodePayload(embed bool, payload json.RawMessage) ([]byte, error) {
+	if embed {
+		return []byte(payload), nil
+	}
+
+	var task []byte
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return nil, serial.ErrSerialization
+	}
+	return task, nil
+}
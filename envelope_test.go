@@ -0,0 +1,181 @@
+package dispatcher_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ZutrixPog/dispatcher"
+	"github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/mem"
+	serial "github.com/ZutrixPog/dispatcher/serialization"
+	"github.com/stretchr/testify/require"
+)
+
+// the fixtures under testdata/envelope are shared with the services writing
+// tasks in other languages, so they only change along with the version.
+// fixtureKeys holds the key v1-aesgcm.json is encrypted with.
+var fixtureKeys = dispatcher.StaticKeys{
+	Current: "2024-03",
+	Keys:    map[string][]byte{"2024-03": []byte("0123456789abcdef0123456789abcdef")},
+}
+
+var envelopes = []struct {
+	file    string
+	wrapper dispatcher.TaskWrapper
+}{
+	{
+		file: "v1-json.json",
+		wrapper: dispatcher.TaskWrapper{
+			ID:        "7f3c2a9e4b1d4c8a9e2f6b0a1c3d5e7f",
+			Type:      "dummy",
+			Codec:     "json",
+			Task:      []byte(`{"Msg":"hello"}`),
+			Headers:   map[string]string{"tenant": "acme"},
+			Priority:  2,
+			Attempts:  1,
+			Retries:   2,
+			Submitted: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		},
+	},
+	{
+		file: "v1-msgpack.json",
+		wrapper: dispatcher.TaskWrapper{
+			ID:        "0b9e8d7c6a5f4e3d2c1b0a9f8e7d6c5b",
+			Type:      "dummy",
+			Codec:     "msgpack",
+			Task:      []byte{0x81, 0xa3, 'M', 's', 'g', 0xa5, 'h', 'e', 'l', 'l', 'o'},
+			Submitted: time.Date(2024, 3, 1, 11, 30, 0, 250000000, time.UTC),
+		},
+	},
+	{
+		file: "v1-snappy.json",
+		wrapper: dispatcher.TaskWrapper{
+			ID:          "9c8b7a6f5e4d4c3b2a1f0e9d8c7b6a5f",
+			Type:        "dummy",
+			Codec:       "json",
+			Compression: "snappy",
+			Task:        []byte{0x0f, 0x38, '{', '"', 'M', 's', 'g', '"', ':', '"', 'h', 'e', 'l', 'l', 'o', '"', '}'},
+			Submitted:   time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		},
+	},
+	{
+		file: "v1-aesgcm.json",
+		wrapper: dispatcher.TaskWrapper{
+			ID:    "3e2d1c0b9a8f4e7d6c5b4a3f2e1d0c9b",
+			Type:  "dummy",
+			Codec: "json",
+			KeyID: "2024-03",
+			Task: append([]byte("fixturenonce"),
+				0x94, 0x81, 0x9f, 0x38, 0x94, 0x2b, 0x7a, 0x4b, 0x52, 0x52, 0xb9, 0xa0, 0xcc, 0x43, 0xb1, 0xa5,
+				0xa8, 0xf9, 0xb7, 0xcc, 0x42, 0x9e, 0x6f, 0x77, 0x27, 0x09, 0xd1, 0xb1, 0x90, 0x14, 0x8f),
+			Submitted: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		},
+	},
+	{
+		file: "v1-saga.json",
+		wrapper: dispatcher.TaskWrapper{
+			ID:        "5d4c3b2a1f0e4d9c8b7a6f5e4d3c2b1a",
+			Type:      "dummy",
+			Codec:     "json",
+			Task:      []byte(`{"Msg":"charge"}`),
+			Retries:   1,
+			Submitted: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+			Saga: &dispatcher.SagaState{
+				ID:    "a1b2c3d4e5f60718293a4b5c6d7e8f90",
+				Codec: "json",
+				Steps: []dispatcher.SagaStep{{
+					Type:             "dummy",
+					Task:             []byte(`{"Msg":"charge"}`),
+					Retries:          1,
+					CompensationType: "dummy",
+					Compensation:     []byte(`{"Msg":"refund"}`),
+				}},
+			},
+		},
+	},
+}
+
+func readEnvelope(t *testing.T, file string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "envelope", file))
+	require.Nil(t, err)
+
+	return data
+}
+
+func TestEnvelope_Golden(t *testing.T) {
+	for _, e := range envelopes {
+		data := readEnvelope(t, e.file)
+
+		wrapper, err := dispatcher.DecodeEnvelope(data)
+		require.Nil(t, err, e.file)
+		require.True(t, e.wrapper.Submitted.Equal(wrapper.Submitted), e.file)
+		wrapper.Submitted = e.wrapper.Submitted
+		if e.wrapper.Codec == "json" && e.wrapper.Compression == "" && e.wrapper.KeyID == "" {
+			// embedded payloads keep the formatting of the fixture.
+			require.JSONEq(t, string(e.wrapper.Task), string(wrapper.Task), e.file)
+			wrapper.Task = e.wrapper.Task
+		}
+		require.Equal(t, e.wrapper, wrapper, e.file)
+
+		encoded, err := dispatcher.EncodeEnvelope(e.wrapper)
+		require.Nil(t, err, e.file)
+		require.JSONEq(t, string(data), string(encoded), "%s is written as in the fixture", e.file)
+	}
+}
+
+func TestEnvelope_Version(t *testing.T) {
+	_, err := dispatcher.DecodeEnvelope([]byte(`{"version": 2, "type": "dummy", "codec": "json", "payload": {}}`))
+	require.ErrorIs(t, err, dispatcher.ErrEnvelopeVersion)
+
+	_, err = dispatcher.DecodeEnvelope([]byte(`{"Type": "dummy"}`))
+	require.ErrorIs(t, err, dispatcher.ErrNotEnvelope, "wrappers written by the JSON serializer are no envelopes")
+}
+
+func TestEnvelope_Dispatch(t *testing.T) {
+	list := mem.NewQueue(10)
+	manager := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithEnvelope(), dispatcher.WithSerializer(serial.JSON{}))
+	defer manager.Release()
+
+	var received []string
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		received = append(received, task.(*DummyTask).Msg)
+		return nil
+	})
+
+	// a task written by another language reaches the queue as is.
+	for _, file := range []string{"v1-json.json", "v1-msgpack.json", "v1-snappy.json"} {
+		_, err := list.Push(context.Background(), "envelopes", queue.Message{Type: "dummy", Data: readEnvelope(t, file)})
+		require.Nil(t, err)
+		require.Nil(t, manager.Dispatch(context.Background(), "envelopes"), file)
+	}
+	require.Equal(t, []string{"hello", "hello", "hello"}, received)
+
+	_, err := manager.Spawn("envelopes", DummyTask{Msg: "spawned"})
+	require.Nil(t, err)
+	task, err := list.Pop(context.Background(), "envelopes")
+	require.Nil(t, err)
+	wrapper, err := dispatcher.DecodeEnvelope(task.Data)
+	require.Nil(t, err, "spawned tasks are written as envelopes")
+	require.NotEmpty(t, wrapper.ID)
+	require.JSONEq(t, `{"Msg":"spawned"}`, string(wrapper.Task))
+}
+
+func TestEnvelope_Encrypted(t *testing.T) {
+	list := mem.NewQueue(10)
+	manager := dispatcher.New(dispatcher.WithQueue(list), dispatcher.WithEncryption(fixtureKeys))
+	defer manager.Release()
+
+	var received []string
+	manager.Task(&DummyTask{}, func(ctx context.Context, task any) error {
+		received = append(received, task.(*DummyTask).Msg)
+		return nil
+	})
+
+	_, err := list.Push(context.Background(), "envelopes", queue.Message{Type: "dummy", Data: readEnvelope(t, "v1-aesgcm.json")})
+	require.Nil(t, err)
+	require.Nil(t, manager.Dispatch(context.Background(), "envelopes"))
+	require.Equal(t, []string{"hello"}, received)
+}
@@ -1,6 +1,10 @@
 package dispatcher
 
-import "errors"
+import (
+	"errors"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+)
 
 var (
 	ErrTaskNotPtr        = errors.New("task refrence is required for registration")
@@ -8,10 +12,20 @@ var (
 	ErrEmptyID           = errors.New("empty ID")
 	ErrUnregisteredTask  = errors.New("task is not registered")
 	ErrTaskAlreadyExists = errors.New("task already exists")
-	ErrEntityNotFound    = errors.New("entity not found")
-	ErrFullQueue         = errors.New("queue is full")
-	ErrEmptyQueue        = errors.New("queue is empty")
-	ErrRetrieveEntity    = errors.New("failed to retrieve entity")
-	ErrCreateEntity      = errors.New("failed to create entity")
-	ErrRemoveEntity      = errors.New("failed to remove entity")
+	ErrEntityNotFound    = tq.ErrEntityNotFound
+	ErrFullQueue         = tq.ErrFullQueue
+	ErrEmptyQueue        = tq.ErrEmptyQueue
+	ErrRetrieveEntity    = tq.ErrRetrieveEntity
+	ErrCreateEntity      = tq.ErrCreateEntity
+	ErrRemoveEntity      = tq.ErrRemoveEntity
+	ErrQueuePaused       = tq.ErrQueuePaused
+	ErrInvalidQueueName  = tq.ErrInvalidQueueName
+	ErrEmptySaga         = errors.New("saga has no steps")
+	ErrNotEnvelope       = errors.New("data is not an envelope")
+	ErrEnvelopeVersion   = errors.New("unsupported envelope version")
+	ErrUnknownKey        = errors.New("unknown encryption key")
+	ErrEncryption        = errors.New("failed to encrypt payload")
+	ErrDecryption        = errors.New("failed to decrypt payload")
+	ErrRequeue           = errors.New("failed to requeue task for retry")
+	ErrDispatcherClosed  = errors.New("dispatcher is released")
 )
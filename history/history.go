@@ -17,6 +17,8 @@ type TaskReport struct {
 	Type      string    `gorm:"not null" json:"type"`
 	Status    string    `gorm:"not null" json:"status"`
 	Queue     string    `gorm:"not null" json:"queue"`
+	Priority  int       `gorm:"not null;default:0" json:"priority"`
+	Saga      string    `gorm:"index" json:"saga,omitempty"`
 	Submitted time.Time `json:"submitted"`
 	CreatedAt time.Time `json:"completed,omitempty"`
 }
@@ -27,6 +29,7 @@ type Query struct {
 	Status string
 	Type   string
 	Queue  string
+	Saga   string
 }
 
 func (query Query) BuildGormQuery(ctx context.Context, db *gorm.DB) *gorm.DB {
@@ -52,6 +55,10 @@ func (query Query) BuildGormQuery(ctx context.Context, db *gorm.DB) *gorm.DB {
 		queryBuilder = queryBuilder.Where(&TaskReport{Queue: query.Queue})
 	}
 
+	if query.Saga != "" {
+		queryBuilder = queryBuilder.Where(&TaskReport{Saga: query.Saga})
+	}
+
 	queryBuilder = queryBuilder.Order("created_at DESC")
 
 	return queryBuilder
@@ -2,6 +2,7 @@ package mocks
 
 import (
 	"context"
+	"sync"
 
 	"github.com/ZutrixPog/dispatcher/history"
 )
@@ -10,6 +11,7 @@ var _ history.TaskHistoryRepo = (*MockHistoryRepo)(nil)
 
 type MockHistoryRepo struct {
 	history []history.TaskReport
+	mu      sync.Mutex
 }
 
 func NewMockHistoryRepo() history.TaskHistoryRepo {
@@ -19,11 +21,17 @@ func NewMockHistoryRepo() history.TaskHistoryRepo {
 }
 
 func (repo *MockHistoryRepo) Append(ctx context.Context, report history.TaskReport) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
 	repo.history = append(repo.history, report)
 	return nil
 }
 
 func (repo *MockHistoryRepo) Retrieve(ctx context.Context, query history.Query) ([]history.TaskReport, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
 	if len(repo.history) == 0 {
 		return nil, nil
 	}
@@ -39,6 +47,9 @@ func (repo *MockHistoryRepo) Retrieve(ctx context.Context, query history.Query)
 		if query.Queue != "" {
 			cond = cond && repo.history[i].Queue == query.Queue
 		}
+		if query.Saga != "" {
+			cond = cond && repo.history[i].Saga == query.Saga
+		}
 
 		if cond {
 			res = append(res, repo.history[i])
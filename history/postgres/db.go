@@ -13,14 +13,18 @@ var (
 	ErrDbInitiationFailed = errors.New("couldn't connect to database")
 )
 
-func InitDB(dsn string, config *gorm.Config) (*gorm.DB, error) {
+// InitDB connects to the database and migrates the history along with any
+// other migrations given, like the one of the postgres queue.
+func InitDB(dsn string, config *gorm.Config, migrations ...func(*gorm.DB) error) (*gorm.DB, error) {
 	db, err := gorm.Open(ps.Open(dsn), config)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := Migrate(db); err != nil {
-		return nil, err
+	for _, migrate := range append([]func(*gorm.DB) error{Migrate}, migrations...) {
+		if err := migrate(db); err != nil {
+			return nil, err
+		}
 	}
 
 	return db, nil
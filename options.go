@@ -0,0 +1,218 @@
+package dispatcher
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ZutrixPog/dispatcher/history"
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/mem"
+	serial "github.com/ZutrixPog/dispatcher/serialization"
+)
+
+const (
+	DEFAULT_WORKERS = 10
+	DEFAULT_LIMIT   = 100
+)
+
+// Logger receives the errors the dispatcher cannot return to a caller, like
+// failures of background tasks. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures a dispatcher created by New.
+type Option func(*options)
+
+type options struct {
+	queue         tq.TaskQueue
+	history       history.TaskHistoryRepo
+	workers       int
+	workerTimeout time.Duration
+	producers     int
+	bgQueue       string
+	deadLetter    string
+	consumed      []WeightedQueue
+	serializer    serial.Serializer
+	readable      []serial.Serializer
+	envelope      bool
+	compressor    serial.Compressor
+	compressAbove int
+	compressors   []serial.Compressor
+	keys          KeyProvider
+	logger        Logger
+	clock         func() time.Time
+	newID         func() string
+	ctx           context.Context
+}
+
+func defaultOptions() options {
+	return options{
+		workers:       DEFAULT_WORKERS,
+		workerTimeout: WORKER_TIMEOUT,
+		producers:     BG_PRODUCERS,
+		bgQueue:       BgQueue,
+		serializer:    serial.Gob{},
+		logger:        log.New(io.Discard, "", 0),
+		clock:         time.Now,
+		newID:         randomID,
+		ctx:           context.Background(),
+	}
+}
+
+// WithQueue sets the queue backend. Defaults to an in-memory queue limited
+// to DEFAULT_LIMIT tasks per queue.
+func WithQueue(queue tq.TaskQueue) Option {
+	return func(o *options) {
+		o.queue = queue
+	}
+}
+
+// WithHistory sets the repository task reports are appended to.
+func WithHistory(repo history.TaskHistoryRepo) Option {
+	return func(o *options) {
+		o.history = repo
+	}
+}
+
+// WithWorkers sets the maximum number of goroutines executing tasks.
+func WithWorkers(workers int) Option {
+	return func(o *options) {
+		o.workers = workers
+	}
+}
+
+// WithWorkerTimeout sets how long an idle worker waits for a task before it
+// exits.
+func WithWorkerTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.workerTimeout = timeout
+	}
+}
+
+// WithProducers sets the number of background runners popping tasks and
+// handing them to the workers. The runners share the workers between them,
+// each popping at most workers/producers tasks, and at least one, ahead of
+// running them. Backends that delete tasks when they are popped, like the
+// mem, disk and postgres ones, lose the tasks popped but not yet run if the
+// process dies, so up to max(workers, producers) tasks.
+func WithProducers(producers int) Option {
+	return func(o *options) {
+		o.producers = producers
+	}
+}
+
+// WithBgQueue sets the queue used by SpawnBg.
+func WithBgQueue(queue string) Option {
+	return func(o *options) {
+		o.bgQueue = queue
+	}
+}
+
+// WithDeadLetterQueue sets the queue tasks are moved to once they failed
+// and have no retries left. The OriginQueueHeader of a dead task names the
+// queue it failed in, and its retries are restored so it can be moved back.
+// Tasks of sagas are compensated instead. Disabled by default.
+func WithDeadLetterQueue(queue string) Option {
+	return func(o *options) {
+		o.deadLetter = queue
+	}
+}
+
+// WithQueues sets the queues consumed by the background runners. Defaults
+// to the background queue alone.
+func WithQueues(queues ...WeightedQueue) Option {
+	return func(o *options) {
+		o.consumed = queues
+	}
+}
+
+// WithSerializer sets the serializer tasks and their wrappers are written
+// with. Tasks written with the readable serializers or the built-in ones are
+// still read, so a queue can be migrated from one codec to another.
+func WithSerializer(serializer serial.Serializer, readable ...serial.Serializer) Option {
+	return func(o *options) {
+		o.serializer = serializer
+		o.readable = readable
+	}
+}
+
+// WithEnvelope writes tasks in the envelope format, which services in other
+// languages can read and write. Envelopes are read whether or not it is set.
+func WithEnvelope() Option {
+	return func(o *options) {
+		o.envelope = true
+	}
+}
+
+// WithCompression compresses the payload of tasks of at least threshold
+// bytes, unless compressing does not make it smaller. Tasks compressed with
+// the readable compressors or the built-in ones are decompressed whether or
+// not it is set. Disabled by default.
+func WithCompression(compressor serial.Compressor, threshold int, readable ...serial.Compressor) Option {
+	return func(o *options) {
+		o.compressor = compressor
+		o.compressAbove = threshold
+		o.compressors = append([]serial.Compressor{compressor}, readable...)
+	}
+}
+
+// WithEncryption encrypts the payload of tasks with AES-GCM, using the
+// current key of the provider. Tasks are decrypted with the key recorded in
+// them, so tasks encrypted before a key was rotated can still be read.
+// Disabled by default.
+func WithEncryption(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithLogger sets the logger for errors of background work. Nothing is
+// logged by default.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithClock sets the source of submission timestamps.
+func WithClock(clock func() time.Time) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithIDGenerator sets the generator of the IDs of spawned tasks, including
+// the steps of sagas, and of the sagas themselves.
+func WithIDGenerator(newID func() string) Option {
+	return func(o *options) {
+		o.newID = newID
+	}
+}
+
+// WithContext sets the parent context of the dispatcher. Cancelling it
+// stops the background runners and timers like Release does.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+func (o *options) apply(opts []Option) {
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.queue == nil {
+		// the background queue is unlimited, whatever it is named.
+		o.queue = mem.NewQueue(DEFAULT_LIMIT, tq.WithLimit(o.bgQueue, 0))
+	}
+	if o.history == nil {
+		o.history = &history.DummyTaskHistoryRepo{}
+	}
+	if len(o.consumed) == 0 {
+		o.consumed = []WeightedQueue{{Name: o.bgQueue}}
+	}
+}
@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMigration = errors.New("outbox migration failed")
+)
+
+var _ tq.Pusher = (*Outbox)(nil)
+
+// Outbox writes tasks to the outbox_tasks table within a transaction of the
+// application database, so they are only forwarded to their queue by a
+// Relay if the transaction commits.
+type Outbox struct {
+	tx *gorm.DB
+}
+
+// New returns an outbox writing within the transaction. Pass it to
+// SpawnWith of the dispatcher:
+//
+//	db.Transaction(func(tx *gorm.DB) error {
+//		...
+//		_, err := td.SpawnWith(outbox.New(tx), "emails", SendEmail{})
+//		return err
+//	})
+func New(tx *gorm.DB) *Outbox {
+	return &Outbox{tx}
+}
+
+// Migrate creates the outbox table. It can be passed to InitDB of the
+// history package to migrate both at once.
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&entry{}); err != nil {
+		return ErrMigration
+	}
+	return nil
+}
+
+// Push adds the task to the outbox. The index of a task in its queue is only
+// known once it is forwarded, so it always returns 0.
+func (o *Outbox) Push(ctx context.Context, queue string, ts tq.Message) (int, error) {
+	headers, _ := json.Marshal(ts.Headers)
+	if len(ts.Headers) == 0 {
+		headers = []byte("{}")
+	}
+	row := entry{
+		Queue:    queue,
+		Type:     ts.Type,
+		Headers:  string(headers),
+		Priority: ts.Priority,
+		Created:  time.Now(),
+		Data:     append([]byte{}, ts.Data...),
+	}
+	if err := o.tx.WithContext(ctx).Create(&row).Error; err != nil {
+		return 0, tq.ErrCreateEntity
+	}
+
+	return 0, nil
+}
+
+type entry struct {
+	ID       int64     `gorm:"primaryKey"`
+	Queue    string    `gorm:"not null"`
+	Type     string    `gorm:"not null"`
+	Headers  string    `gorm:"type:jsonb;not null"`
+	Priority int       `gorm:"not null"`
+	Created  time.Time `gorm:"not null"`
+	Data     []byte    `gorm:"not null"`
+}
+
+func (entry) TableName() string {
+	return "outbox_tasks"
+}
+
+func (e entry) message() tq.Message {
+	ts := tq.Message{Type: e.Type, Priority: e.Priority, Data: e.Data}
+	if ts.Data == nil {
+		ts.Data = []byte{}
+	}
+	if json.Unmarshal([]byte(e.Headers), &ts.Headers) != nil || len(ts.Headers) == 0 {
+		ts.Headers = nil
+	}
+
+	return ts
+}
@@ -0,0 +1,145 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ZutrixPog/dispatcher/outbox"
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/mem"
+	"github.com/ZutrixPog/dispatcher/queue/postgres"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+var errRollback = errors.New("rollback")
+
+func TestOutbox_Commit(t *testing.T) {
+	queue := mem.NewQueue(10)
+	relay := outbox.NewRelay(db, queue)
+
+	email := tq.Message{Type: "email", Headers: map[string]string{"tenant": "acme"}, Priority: 2, Data: []byte("order 1")}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := outbox.New(tx).Push(context.Background(), "emails", tq.Message{Type: "email", Data: []byte("order 0")})
+		require.NoError(t, err)
+		return errRollback
+	})
+	require.ErrorIs(t, err, errRollback)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		_, err := outbox.New(tx).Push(context.Background(), "emails", email)
+		return err
+	})
+	require.NoError(t, err)
+
+	n, err := relay.Forward(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n, "only committed tasks are forwarded")
+
+	task, err := queue.Pop(context.Background(), "emails")
+	require.NoError(t, err)
+	require.Equal(t, email.Type, task.Type)
+	require.Equal(t, email.Headers, task.Headers)
+	require.Equal(t, email.Priority, task.Priority)
+	require.Equal(t, email.Data, task.Data)
+
+	n, err = relay.Forward(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, n, "forwarded tasks leave the outbox")
+}
+
+func TestRelay_FullQueue(t *testing.T) {
+	queue := mem.NewQueue(1)
+	relay := outbox.NewRelay(db, queue)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, data := range []string{"a", "b"} {
+			if _, err := outbox.New(tx).Push(context.Background(), "emails", tq.Message{Data: []byte(data)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	n, err := relay.Forward(context.Background())
+	require.ErrorIs(t, err, tq.ErrFullQueue)
+	require.Equal(t, 1, n, "tasks forwarded before the failure are kept")
+
+	task, err := queue.Pop(context.Background(), "emails")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), task.Data)
+
+	n, err = relay.Forward(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n, "the task that failed is retried")
+
+	task, err = queue.Pop(context.Background(), "emails")
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), task.Data)
+}
+
+func TestRelay_FullQueueSkipped(t *testing.T) {
+	full, healthy := fmt.Sprintf("full-%d", time.Now().UnixNano()), fmt.Sprintf("healthy-%d", time.Now().UnixNano())
+	queue := mem.NewQueue(10, tq.WithLimit(full, 1))
+	relay := outbox.NewRelay(db, queue)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range []struct{ queue, data string }{{full, "a"}, {full, "b"}, {full, "c"}, {healthy, "d"}} {
+			if _, err := outbox.New(tx).Push(context.Background(), row.queue, tq.Message{Data: []byte(row.data)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	n, err := relay.Forward(context.Background())
+	require.ErrorIs(t, err, tq.ErrFullQueue)
+	require.Equal(t, 2, n, "the tasks of other queues are forwarded past a full one")
+
+	task, err := queue.Pop(context.Background(), healthy)
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), task.Data)
+
+	task, err = queue.Pop(context.Background(), full)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), task.Data)
+
+	n, err = relay.Forward(context.Background())
+	require.ErrorIs(t, err, tq.ErrFullQueue)
+	require.Equal(t, 1, n)
+	task, err = queue.Pop(context.Background(), full)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), task.Data, "the tasks of a full queue are forwarded in order")
+}
+
+func TestRelay_TxQueue(t *testing.T) {
+	name := fmt.Sprintf("outbox-%d", time.Now().UnixNano())
+	queue := postgres.NewTaskQueue(db, 10)
+	relay := outbox.NewRelay(db, queue, outbox.WithInterval(10*time.Millisecond))
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := outbox.New(tx).Push(context.Background(), name, tq.Message{Data: []byte("a")})
+		return err
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- relay.Run(ctx)
+	}()
+
+	popCtx, popCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer popCancel()
+	task, err := queue.BlockingPop(popCtx, name)
+	require.NoError(t, err, "the relay did not forward the task")
+	require.Equal(t, []byte("a"), task.Data)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,202 @@
+package outbox
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DefaultInterval = time.Second
+	DefaultBatch    = 100
+)
+
+// TxQueue is implemented by queues kept in the database of the outbox, like
+// the postgres queue. The relay pushes to them within the transaction that
+// deletes the forwarded rows, so every task is forwarded exactly once.
+type TxQueue interface {
+	InTx(tx *gorm.DB) tq.TaskQueue
+}
+
+// Logger receives the errors of the relay. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// RelayOption configures a Relay created by NewRelay.
+type RelayOption func(*Relay)
+
+// WithInterval sets how long the relay waits after finding the outbox
+// empty. It defaults to DefaultInterval.
+func WithInterval(interval time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.interval = interval
+	}
+}
+
+// WithBatch sets how many rows the relay forwards per transaction. It
+// defaults to DefaultBatch.
+func WithBatch(batch int) RelayOption {
+	return func(r *Relay) {
+		r.batch = batch
+	}
+}
+
+// WithLogger sets where errors of the relay are logged. They are discarded
+// by default.
+func WithLogger(logger Logger) RelayOption {
+	return func(r *Relay) {
+		r.logger = logger
+	}
+}
+
+// Relay forwards the tasks of committed transactions from the outbox to
+// their queues in the order they were written. Rows are claimed with FOR
+// UPDATE SKIP LOCKED, so several relays can share an outbox, and a row is
+// deleted in the transaction that forwarded it. A task that can not be
+// pushed, to a full queue for example, stays in the outbox and is retried
+// before any task of its queue written after it, while the tasks of other
+// queues are still forwarded.
+//
+// Pushes to a queue outside the database can not join the transaction: a
+// crash after such a push and before the commit forwards the task again.
+type Relay struct {
+	db       *gorm.DB
+	queue    tq.TaskQueue
+	interval time.Duration
+	batch    int
+	logger   Logger
+}
+
+func NewRelay(db *gorm.DB, queue tq.TaskQueue, opts ...RelayOption) *Relay {
+	r := &Relay{
+		db:       db,
+		queue:    queue,
+		interval: DefaultInterval,
+		batch:    DefaultBatch,
+		logger:   log.New(io.Discard, "", 0),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Run forwards tasks until ctx is done.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Forward(ctx)
+		if err != nil {
+			r.logger.Printf("outbox relay: %v", err)
+		}
+		if n > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// Forward forwards a batch of tasks and returns how many were forwarded.
+// When a push fails the rest of the tasks of its queue are left in the
+// outbox, the tasks of other queues are still forwarded and the first error
+// is returned along with their number.
+func (r *Relay) Forward(ctx context.Context) (int, error) {
+	var forwarded int
+	var pushErr error
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		queue := r.queue
+		txQueue, inTx := queue.(TxQueue)
+		if inTx {
+			queue = txQueue.InTx(tx)
+		}
+
+		ids := make([]int64, 0, r.batch)
+		parked := make(map[string]bool)
+		var last int64
+		// the rows of a queue a push failed for are skipped, and more rows
+		// of the other queues are claimed in their place.
+		for len(ids) < r.batch {
+			claim := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("id > ?", last).Order("id").Limit(r.batch - len(ids))
+			if len(parked) > 0 {
+				claim = claim.Where("queue NOT IN ?", keys(parked))
+			}
+			var rows []entry
+			if err := claim.Find(&rows).Error; err != nil {
+				return err
+			}
+
+			parkedBefore := len(parked)
+			for _, row := range rows {
+				last = row.ID
+				if parked[row.Queue] {
+					continue
+				}
+				if err := r.push(ctx, tx, queue, inTx, row); err != nil {
+					if pushErr == nil {
+						pushErr = err
+					}
+					parked[row.Queue] = true
+					continue
+				}
+				ids = append(ids, row.ID)
+			}
+			if len(parked) == parkedBefore {
+				break
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		forwarded = len(ids)
+		return tx.Delete(&entry{}, ids).Error
+	})
+	if err != nil {
+		return 0, tq.ErrRemoveEntity
+	}
+
+	return forwarded, pushErr
+}
+
+// push forwards a row. A failed push to a queue within the transaction is
+// rolled back to a savepoint, so that it does not abort the pushes of the
+// other rows.
+func (r *Relay) push(ctx context.Context, tx *gorm.DB, queue tq.TaskQueue, inTx bool, row entry) error {
+	if !inTx {
+		_, err := queue.Push(ctx, row.Queue, row.message())
+		return err
+	}
+
+	if err := tx.SavePoint("outbox_push").Error; err != nil {
+		return err
+	}
+	if _, err := queue.Push(ctx, row.Queue, row.message()); err != nil {
+		if rollbackErr := tx.RollbackTo("outbox_push").Error; rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return nil
+}
+
+func keys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
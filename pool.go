@@ -1,6 +1,7 @@
 package dispatcher
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -15,49 +16,85 @@ type WorkerPool struct {
 	jobs       chan taskFn
 	maxWorkers int
 	workers    int
+	timeout    time.Duration
 	done       chan struct{}
 
-	mu sync.Mutex
+	mu      sync.Mutex
+	release sync.Once
 }
 
 func NewPool(workers int) *WorkerPool {
+	return newPool(workers, WORKER_TIMEOUT)
+}
+
+func newPool(workers int, timeout time.Duration) *WorkerPool {
 	workerpool := &WorkerPool{
 		jobs:       make(chan taskFn),
 		done:       make(chan struct{}),
 		workers:    0,
 		maxWorkers: workers,
+		timeout:    timeout,
 	}
 
 	return workerpool
 }
 
 func (w *WorkerPool) Submit(f taskFn) {
+	w.reserve()
+	w.jobs <- f
+}
+
+// submit is Submit giving up once ctx is done. It reports whether f was
+// submitted.
+func (w *WorkerPool) submit(ctx context.Context, f taskFn) bool {
+	w.reserve()
+	select {
+	case w.jobs <- f:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reserve starts a worker for the next job unless the pool is at its limit.
+func (w *WorkerPool) reserve() {
 	w.mu.Lock()
-	defer w.mu.Unlock()
 	if w.workers < w.maxWorkers {
 		w.addWorker()
 		w.workers += 1
 	}
-	w.jobs <- f
+	w.mu.Unlock()
 }
 
+// addWorker starts a worker that keeps taking jobs until it has been idle
+// for the pool timeout.
 func (w *WorkerPool) addWorker() {
 	go func() {
-		tout := time.NewTimer(WORKER_TIMEOUT)
-		select {
-		case job := <-w.jobs:
-			job()
-		case <-w.done:
-			return
-		case <-tout.C:
-			w.mu.Lock()
-			w.workers -= 1
-			w.mu.Unlock()
-			return
+		tout := time.NewTimer(w.timeout)
+		defer tout.Stop()
+		for {
+			select {
+			case job := <-w.jobs:
+				job()
+				if !tout.Stop() {
+					<-tout.C
+				}
+				tout.Reset(w.timeout)
+			case <-w.done:
+				return
+			case <-tout.C:
+				w.mu.Lock()
+				w.workers -= 1
+				w.mu.Unlock()
+				return
+			}
 		}
 	}()
 }
 
+// Release stops the idle workers. Releasing a released pool does nothing.
 func (w *WorkerPool) Release() {
-	w.done <- struct{}{}
+	w.release.Do(func() {
+		close(w.done)
+	})
 }
@@ -0,0 +1,793 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	bolt "go.etcd.io/bbolt"
+)
+
+const openTimeout = time.Second
+
+var (
+	tasksBucket = []byte("tasks")
+	pausedKey   = []byte("paused")
+	enqueuedKey = []byte("enqueued")
+	dequeuedKey = []byte("dequeued")
+	lengthKey   = []byte("length")
+)
+
+var (
+	_ tq.TaskQueue = (*Queue)(nil)
+	_ tq.Releaser  = (*Queue)(nil)
+)
+
+// Sync is how often the queue flushes its writes to disk. Every write is
+// atomic and a crash of the process loses nothing whatever the policy; the
+// policy only matters when the machine crashes or loses power.
+type Sync time.Duration
+
+const (
+	// SyncAlways flushes every write before it returns, so a write that
+	// returned survives any crash. It is the default and the slowest.
+	SyncAlways Sync = 0
+	// SyncNever leaves flushing to the operating system.
+	SyncNever Sync = -1
+)
+
+// SyncEvery flushes the writes in the background every interval instead of
+// on every write. A crash of the machine can lose or corrupt the writes of
+// the last interval.
+func SyncEvery(interval time.Duration) Sync {
+	return Sync(interval)
+}
+
+// Queue keeps every queue as a bucket of a bbolt file, with its tasks in a
+// nested bucket keyed by priority and push sequence so that the keys sort in
+// pop order. The file is locked by the process that opened it, so blocked
+// pops and pushes are woken in process whenever a write commits.
+type Queue struct {
+	db      *bolt.DB
+	root    []byte
+	limit   int64
+	config  tq.Config
+	changed *notifier
+	done    chan struct{}
+	closed  sync.Once
+	err     error
+}
+
+// NewTaskQueue opens the queue file at path, creating it if needed. Only one
+// queue can have the file open at a time, so it fails if another process
+// holds it. The queues of a namespace are kept apart from the others in the
+// same file.
+func NewTaskQueue(path string, sync Sync, limit int64, opts ...tq.Option) (*Queue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = sync != SyncAlways
+
+	config := tq.NewConfig(opts...)
+	root := []byte("queues")
+	if config.Namespace() != "" {
+		root = []byte("queues:" + config.Namespace())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(root)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &Queue{db: db, root: root, limit: limit, config: config, changed: &notifier{wake: make(chan struct{})}, done: make(chan struct{})}
+	if sync > 0 {
+		go q.flush(time.Duration(sync))
+	}
+
+	return q, nil
+}
+
+// Close flushes the pending writes and releases the file. Closing a closed
+// queue returns the error of the first Close.
+func (q *Queue) Close() error {
+	q.closed.Do(func() {
+		close(q.done)
+		if err := q.db.Sync(); err != nil {
+			q.db.Close()
+			q.err = err
+			return
+		}
+		q.err = q.db.Close()
+	})
+
+	return q.err
+}
+
+// Release closes the queue, so that a dispatcher releases it along with
+// itself.
+func (q *Queue) Release() error {
+	return q.Close()
+}
+
+func (q *Queue) flush(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.db.Sync()
+		}
+	}
+}
+
+type record struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Priority int               `json:"priority"`
+	Enqueued time.Time         `json:"enqueued"`
+	Data     []byte            `json:"data"`
+}
+
+// Push waits for a write to the queue while it is full and has the Block
+// overflow policy.
+func (q *Queue) Push(ctx context.Context, queue string, ts tq.Message) (int, error) {
+	for {
+		wake := q.changed.wait()
+		index, err := q.push(queue, ts, true)
+		if err != tq.ErrFullQueue || q.config.Overflow(queue) != tq.Block {
+			return index, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (q *Queue) Requeue(ctx context.Context, queue string, ts tq.Message) error {
+	_, err := q.push(queue, ts, false)
+	return err
+}
+
+// push pushes a task, under the limit of the queue when bounded.
+func (q *Queue) push(queue string, ts tq.Message, bounded bool) (int, error) {
+	var index int
+	err := q.update(func(root *bolt.Bucket) error {
+		b, err := q.create(root, queue)
+		if err != nil {
+			return err
+		}
+
+		if bounded && q.config.Full(queue, int(counter(b, lengthKey)), 1, q.limit) {
+			if q.config.Overflow(queue) != tq.DropOldest {
+				return tq.ErrFullQueue
+			}
+			if err := q.dropOldest(b, queue); err != nil {
+				return err
+			}
+		}
+
+		key, err := q.insert(b, queue, ts)
+		if err != nil {
+			return err
+		}
+
+		c := b.Bucket(tasksBucket).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, key) < 0; k, _ = c.Next() {
+			index++
+		}
+		return nil
+	})
+	if err == tq.ErrFullQueue {
+		return 0, err
+	}
+	if err != nil {
+		return 0, tq.ErrCreateEntity
+	}
+
+	return index, nil
+}
+
+// dropOldest removes the oldest task of the lowest priority, the last task
+// of a LIFO queue or the first task of the last priority of a FIFO one.
+func (q *Queue) dropOldest(b *bolt.Bucket, queue string) error {
+	c := b.Bucket(tasksBucket).Cursor()
+	k, _ := c.Last()
+	if k == nil {
+		return nil
+	}
+	if q.config.Order(queue) == tq.FIFO {
+		c.Seek(k[:8])
+	}
+	if err := c.Delete(); err != nil {
+		return err
+	}
+
+	return add(b, lengthKey, -1)
+}
+
+// insert adds the task to the queue with a key that sorts it in pop order.
+func (q *Queue) insert(b *bolt.Bucket, queue string, ts tq.Message) ([]byte, error) {
+	tasks := b.Bucket(tasksBucket)
+	seq, err := tasks.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := json.Marshal(record{
+		ID:       strconv.FormatUint(seq, 10),
+		Type:     ts.Type,
+		Headers:  ts.Headers,
+		Priority: ts.Priority,
+		Enqueued: time.Now(),
+		Data:     ts.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 16)
+	// flipping the sign bit sorts priorities as unsigned integers, and
+	// inverting them puts the highest first.
+	binary.BigEndian.PutUint64(key, ^(uint64(ts.Priority) ^ 1<<63))
+	if q.config.Order(queue) == tq.LIFO {
+		seq = ^seq
+	}
+	binary.BigEndian.PutUint64(key[8:], seq)
+
+	if err := tasks.Put(key, value); err != nil {
+		return nil, err
+	}
+	if err := add(b, lengthKey, 1); err != nil {
+		return nil, err
+	}
+
+	return key, add(b, enqueuedKey, 1)
+}
+
+func (q *Queue) Pop(ctx context.Context, queue string) (tq.Message, error) {
+	return q.pop(queue, tq.Filter{})
+}
+
+func (q *Queue) PopFilter(ctx context.Context, queue string, filter tq.Filter) (tq.Message, error) {
+	return q.pop(queue, filter)
+}
+
+func (q *Queue) pop(queue string, filter tq.Filter) (tq.Message, error) {
+	var ts tq.Message
+	err := q.update(func(root *bolt.Bucket) error {
+		b := root.Bucket([]byte(queue))
+		if b == nil {
+			return tq.ErrEmptyQueue
+		}
+		if counter(b, pausedKey) > 0 {
+			return tq.ErrQueuePaused
+		}
+
+		c := b.Bucket(tasksBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			msg, err := message(queue, v)
+			if err != nil {
+				return err
+			}
+			if !filter.Match(msg) {
+				continue
+			}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			if err := add(b, lengthKey, -1); err != nil {
+				return err
+			}
+			ts = msg
+			return add(b, dequeuedKey, 1)
+		}
+
+		return tq.ErrEmptyQueue
+	})
+	if err == tq.ErrEmptyQueue || err == tq.ErrQueuePaused {
+		return tq.Message{}, err
+	}
+	if err != nil {
+		return tq.Message{}, tq.ErrRetrieveEntity
+	}
+
+	return ts, nil
+}
+
+// PopN pops the tasks in a single transaction, so a batch takes one write.
+func (q *Queue) PopN(ctx context.Context, queue string, n int) ([]tq.Message, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	var popped []tq.Message
+	err := q.update(func(root *bolt.Bucket) error {
+		b := root.Bucket([]byte(queue))
+		if b == nil {
+			return tq.ErrEmptyQueue
+		}
+		if counter(b, pausedKey) > 0 {
+			return tq.ErrQueuePaused
+		}
+
+		c := b.Bucket(tasksBucket).Cursor()
+		for k, v := c.First(); k != nil && len(popped) < n; k, v = c.First() {
+			msg, err := message(queue, v)
+			if err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			popped = append(popped, msg)
+		}
+		if len(popped) == 0 {
+			return tq.ErrEmptyQueue
+		}
+
+		if err := add(b, lengthKey, -int64(len(popped))); err != nil {
+			return err
+		}
+		return add(b, dequeuedKey, int64(len(popped)))
+	})
+	if err == tq.ErrEmptyQueue || err == tq.ErrQueuePaused {
+		return nil, err
+	}
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	return popped, nil
+}
+
+// BlockingPop tries the queues in order and, when none has a task to pop,
+// waits for the next write.
+func (q *Queue) BlockingPop(ctx context.Context, queues ...string) (tq.Message, error) {
+	for {
+		wake := q.changed.wait()
+		if err := ctx.Err(); err != nil {
+			return tq.Message{}, err
+		}
+		for _, queue := range queues {
+			ts, err := q.pop(queue, tq.Filter{})
+			if err != tq.ErrEmptyQueue && err != tq.ErrQueuePaused {
+				return ts, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return tq.Message{}, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (q *Queue) Get(ctx context.Context, queue string, index int) (tq.Message, error) {
+	var ts tq.Message
+	err := q.view(func(root *bolt.Bucket) error {
+		c, v := seek(root, queue, index)
+		if c == nil {
+			return tq.ErrEntityNotFound
+		}
+
+		var err error
+		ts, err = message(queue, v)
+		return err
+	})
+	if err == tq.ErrEntityNotFound {
+		return tq.Message{}, err
+	}
+	if err != nil {
+		return tq.Message{}, tq.ErrRetrieveEntity
+	}
+
+	return ts, nil
+}
+
+// List decodes only the tasks it checks against the page, so the tasks
+// before the offset of an unfiltered page are skipped without decoding them.
+func (q *Queue) List(ctx context.Context, queue string, page tq.Page) ([]tq.Message, error) {
+	var msgs []tq.Message
+	err := q.view(func(root *bolt.Bucket) error {
+		b := root.Bucket([]byte(queue))
+		if b == nil {
+			return nil
+		}
+
+		skipped := 0
+		c := b.Bucket(tasksBucket).Cursor()
+		for k, v := c.First(); k != nil && !page.Full(len(msgs)); k, v = c.Next() {
+			if page.Unfiltered() && skipped < page.Offset {
+				skipped++
+				continue
+			}
+
+			msg, err := message(queue, v)
+			if err != nil {
+				return err
+			}
+			if !page.Match(msg) {
+				continue
+			}
+			if skipped < page.Offset {
+				skipped++
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+	if len(msgs) == 0 {
+		return nil, tq.ErrEmptyQueue
+	}
+
+	return msgs, nil
+}
+
+func (q *Queue) Remove(ctx context.Context, queue string, index int) error {
+	err := q.update(func(root *bolt.Bucket) error {
+		c, _ := seek(root, queue, index)
+		if c == nil {
+			return tq.ErrEntityNotFound
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+
+		return add(root.Bucket([]byte(queue)), lengthKey, -1)
+	})
+	if err == tq.ErrEntityNotFound {
+		return err
+	}
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+
+	return nil
+}
+
+func (q *Queue) RemoveID(ctx context.Context, queue string, id string) error {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return tq.ErrEntityNotFound
+	}
+	// the sequence ends the key of the task, inverted in LIFO queues.
+	if q.config.Order(queue) == tq.LIFO {
+		seq = ^seq
+	}
+
+	err = q.update(func(root *bolt.Bucket) error {
+		b := root.Bucket([]byte(queue))
+		if b == nil {
+			return tq.ErrEntityNotFound
+		}
+
+		c := b.Bucket(tasksBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if binary.BigEndian.Uint64(k[8:]) != seq {
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			return add(b, lengthKey, -1)
+		}
+
+		return tq.ErrEntityNotFound
+	})
+	if err == tq.ErrEntityNotFound {
+		return err
+	}
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+
+	return nil
+}
+
+func (q *Queue) Pause(ctx context.Context, queue string) error {
+	return q.setPaused(queue, 1)
+}
+
+func (q *Queue) Resume(ctx context.Context, queue string) error {
+	return q.setPaused(queue, 0)
+}
+
+func (q *Queue) setPaused(queue string, paused int64) error {
+	err := q.update(func(root *bolt.Bucket) error {
+		b, err := q.create(root, queue)
+		if err != nil {
+			return err
+		}
+
+		return put(b, pausedKey, paused)
+	})
+	if err != nil {
+		return tq.ErrCreateEntity
+	}
+
+	return nil
+}
+
+func (q *Queue) Paused(ctx context.Context, queue string) (bool, error) {
+	var paused bool
+	err := q.view(func(root *bolt.Bucket) error {
+		if b := root.Bucket([]byte(queue)); b != nil {
+			paused = counter(b, pausedKey) > 0
+		}
+		return nil
+	})
+	if err != nil {
+		return false, tq.ErrRetrieveEntity
+	}
+
+	return paused, nil
+}
+
+func (q *Queue) Delete(ctx context.Context, queue string, filter tq.Filter) ([]tq.Message, error) {
+	var removed []tq.Message
+	err := q.update(func(root *bolt.Bucket) error {
+		var err error
+		removed, err = q.delete(root, queue, filter)
+		return err
+	})
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return removed, nil
+}
+
+func (q *Queue) Move(ctx context.Context, from, to string, filter tq.Filter) ([]tq.Message, error) {
+	if from == to {
+		return nil, nil
+	}
+
+	var moved []tq.Message
+	err := q.update(func(root *bolt.Bucket) error {
+		var err error
+		moved, err = q.delete(root, from, filter)
+		if err != nil || len(moved) == 0 {
+			return err
+		}
+
+		b, err := q.create(root, to)
+		if err != nil {
+			return err
+		}
+		if q.config.Full(to, int(counter(b, lengthKey)), len(moved), q.limit) {
+			return tq.ErrFullQueue
+		}
+
+		for _, ts := range moved {
+			if _, err := q.insert(b, to, ts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == tq.ErrFullQueue {
+		return nil, err
+	}
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return moved, nil
+}
+
+// delete removes the tasks of the queue matching the filter and returns
+// them in pop order.
+func (q *Queue) delete(root *bolt.Bucket, queue string, filter tq.Filter) ([]tq.Message, error) {
+	b := root.Bucket([]byte(queue))
+	if b == nil {
+		return nil, nil
+	}
+
+	var removed []tq.Message
+	c := b.Bucket(tasksBucket).Cursor()
+	for k, v := c.First(); k != nil; {
+		msg, err := message(queue, v)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.Match(msg) {
+			k, v = c.Next()
+			continue
+		}
+
+		// deleting moves the cursor back, so seek to the key after it.
+		next := append(append([]byte{}, k...), 0)
+		if err := c.Delete(); err != nil {
+			return nil, err
+		}
+		removed = append(removed, msg)
+		k, v = c.Seek(next)
+	}
+
+	return removed, add(b, lengthKey, -int64(len(removed)))
+}
+
+func (q *Queue) ListQueues(ctx context.Context) ([]string, error) {
+	queues := make([]string, 0)
+	err := q.view(func(root *bolt.Bucket) error {
+		return root.ForEach(func(k, v []byte) error {
+			if counter(root.Bucket(k), enqueuedKey) > 0 {
+				queues = append(queues, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	return queues, nil
+}
+
+func (q *Queue) QueueStats(ctx context.Context, queue string) (tq.Stats, error) {
+	stats := tq.Stats{Queue: queue}
+	err := q.view(func(root *bolt.Bucket) error {
+		b := root.Bucket([]byte(queue))
+		if b == nil {
+			return nil
+		}
+
+		stats.Length = int(counter(b, lengthKey))
+		stats.Paused = counter(b, pausedKey) > 0
+		stats.Enqueued = counter(b, enqueuedKey)
+		stats.Dequeued = counter(b, dequeuedKey)
+		return b.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			msg, err := message(queue, v)
+			if err == nil && (stats.Oldest.IsZero() || msg.Enqueued.Before(stats.Oldest)) {
+				stats.Oldest = msg.Enqueued
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+	stats.At = time.Now()
+
+	return stats, nil
+}
+
+// update runs fn in a write transaction on the bucket of the namespace and
+// wakes the blocked pops and pushes if it commits.
+func (q *Queue) update(fn func(root *bolt.Bucket) error) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(q.root))
+	})
+	if err == nil {
+		q.changed.broadcast()
+	}
+
+	return err
+}
+
+func (q *Queue) view(fn func(root *bolt.Bucket) error) error {
+	return q.db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(q.root))
+	})
+}
+
+// create returns the bucket of the queue, creating it along with its tasks
+// bucket if needed.
+func (q *Queue) create(root *bolt.Bucket, queue string) (*bolt.Bucket, error) {
+	b, err := root.CreateBucketIfNotExists([]byte(queue))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.CreateBucketIfNotExists(tasksBucket); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// seek returns a cursor positioned on the task at the index of the queue
+// along with the task, or a nil cursor if there is none.
+func seek(root *bolt.Bucket, queue string, index int) (*bolt.Cursor, []byte) {
+	b := root.Bucket([]byte(queue))
+	if b == nil || index < 0 {
+		return nil, nil
+	}
+
+	c := b.Bucket(tasksBucket).Cursor()
+	k, v := c.First()
+	for i := 0; k != nil && i < index; i++ {
+		k, v = c.Next()
+	}
+	if k == nil {
+		return nil, nil
+	}
+
+	return c, v
+}
+
+func message(queue string, value []byte) (tq.Message, error) {
+	var r record
+	if err := json.Unmarshal(value, &r); err != nil {
+		return tq.Message{}, err
+	}
+
+	ts := tq.Message{
+		ID:       r.ID,
+		Queue:    queue,
+		Type:     r.Type,
+		Headers:  r.Headers,
+		Priority: r.Priority,
+		Enqueued: r.Enqueued,
+		Data:     r.Data,
+	}
+	if ts.Data == nil {
+		ts.Data = []byte{}
+	}
+
+	return ts, nil
+}
+
+func counter(b *bolt.Bucket, key []byte) int64 {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func put(b *bolt.Bucket, key []byte, value int64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(value))
+
+	return b.Put(key, v)
+}
+
+func add(b *bolt.Bucket, key []byte, delta int64) error {
+	return put(b, key, counter(b, key)+delta)
+}
+
+// notifier wakes every waiter by closing the channel they wait on.
+type notifier struct {
+	lock sync.Mutex
+	wake chan struct{}
+}
+
+// wait returns a channel closed by the next broadcast.
+func (n *notifier) wait() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.wake
+}
+
+func (n *notifier) broadcast() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	close(n.wake)
+	n.wake = make(chan struct{})
+}
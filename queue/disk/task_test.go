@@ -0,0 +1,104 @@
+package disk_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/disk"
+	"github.com/ZutrixPog/dispatcher/queue/queuetest"
+	"github.com/stretchr/testify/require"
+)
+
+func open(t *testing.T, path string, sync disk.Sync, opts ...tq.Option) *disk.Queue {
+	q, err := disk.NewTaskQueue(path, sync, 10, opts...)
+	require.NoError(t, err)
+
+	return q
+}
+
+func TestQueue_Conformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		q, err := disk.NewTaskQueue(filepath.Join(t.TempDir(), "queue.db"), disk.SyncNever, limit, opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { q.Close() })
+
+		return q
+	})
+}
+
+func TestQueue_Reopen(t *testing.T) {
+	for _, sync := range []disk.Sync{disk.SyncAlways, disk.SyncEvery(10 * time.Millisecond), disk.SyncNever} {
+		path := filepath.Join(t.TempDir(), "queue.db")
+		q := open(t, path, sync)
+		for _, data := range []string{"a", "b", "c"} {
+			_, err := q.Push(context.Background(), "reopen", tq.Message{Type: "dummy", Data: []byte(data)})
+			require.NoError(t, err)
+		}
+		_, err := q.Pop(context.Background(), "reopen")
+		require.NoError(t, err)
+		require.NoError(t, q.Pause(context.Background(), "reopen"))
+		require.NoError(t, q.Close())
+
+		q = open(t, path, sync)
+		paused, err := q.Paused(context.Background(), "reopen")
+		require.NoError(t, err)
+		require.True(t, paused, "pause state survives a restart")
+		require.NoError(t, q.Resume(context.Background(), "reopen"))
+
+		_, err = q.Push(context.Background(), "reopen", tq.Message{Type: "dummy", Data: []byte("d")})
+		require.NoError(t, err)
+		for _, data := range []string{"b", "c", "d"} {
+			task, err := q.Pop(context.Background(), "reopen")
+			require.NoError(t, err)
+			require.Equal(t, []byte(data), task.Data, "tasks pushed after a restart queue up behind the others")
+		}
+
+		stats, err := q.QueueStats(context.Background(), "reopen")
+		require.NoError(t, err)
+		require.Equal(t, int64(4), stats.Enqueued)
+		require.Equal(t, int64(4), stats.Dequeued)
+		require.NoError(t, q.Close())
+	}
+}
+
+func TestQueue_Locked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := open(t, path, disk.SyncAlways)
+	defer q.Close()
+
+	_, err := disk.NewTaskQueue(path, disk.SyncAlways, 10)
+	require.Error(t, err, "only one queue can have the file open")
+}
+
+func TestQueue_Release(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := open(t, path, disk.SyncEvery(10*time.Millisecond))
+	_, err := q.Push(context.Background(), "release", tq.Message{Data: []byte("a")})
+	require.NoError(t, err)
+
+	var releaser tq.Releaser = q
+	require.NoError(t, releaser.Release())
+	require.NoError(t, q.Close(), "closing a released queue is a no-op")
+
+	q = open(t, path, disk.SyncAlways)
+	defer q.Close()
+	task, err := q.Pop(context.Background(), "release")
+	require.NoError(t, err, "the file is released")
+	require.Equal(t, []byte("a"), task.Data)
+}
+
+func TestQueue_Namespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := open(t, path, disk.SyncAlways, tq.WithNamespace("billing"))
+	_, err := q.Push(context.Background(), "shared", tq.Message{Data: []byte("billing")})
+	require.NoError(t, err)
+	require.NoError(t, q.Close())
+
+	q = open(t, path, disk.SyncAlways)
+	defer q.Close()
+	_, err = q.Pop(context.Background(), "shared")
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "queues of other namespaces are not visible")
+}
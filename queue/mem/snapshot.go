@@ -0,0 +1,202 @@
+package mem
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+)
+
+const snapshotVersion = 1
+
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+var _ tq.Releaser = (*MemQueue)(nil)
+
+// Snapshot configures how a MemQueue persists its queues to a file.
+type Snapshot struct {
+	// Path is the file the queues are saved to and restored from.
+	Path string
+	// Interval is how often the queues are saved in the background. Zero
+	// only saves them on demand and on Release.
+	Interval time.Duration
+	// OnError receives the errors of background saves. They are ignored by
+	// default.
+	OnError func(err error)
+}
+
+type snapshot struct {
+	Version int                      `json:"version"`
+	Queues  map[string]snapshotQueue `json:"queues"`
+}
+
+type snapshotQueue struct {
+	Tasks    []tq.Message `json:"tasks,omitempty"`
+	Paused   bool         `json:"paused,omitempty"`
+	Enqueued int64        `json:"enqueued"`
+	Dequeued int64        `json:"dequeued"`
+}
+
+// NewSnapshotQueue restores the queues saved at the path of the snapshot, if
+// the file exists, and saves them there periodically and on Release. Tasks
+// pushed after the last save are lost if the process dies, as are tasks
+// popped but still running when it is released.
+func NewSnapshotQueue(snapshot Snapshot, limit int64, opts ...tq.Option) (*MemQueue, error) {
+	q := NewQueue(limit, opts...).(*MemQueue)
+	q.snapshot = snapshot
+	if err := q.Restore(snapshot.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if snapshot.Interval > 0 {
+		go q.saveEvery(snapshot.Interval)
+	}
+
+	return q, nil
+}
+
+func (q *MemQueue) saveEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			if err := q.Save(q.snapshot.Path); err != nil && q.snapshot.OnError != nil {
+				q.snapshot.OnError(err)
+			}
+		}
+	}
+}
+
+// Release stops the background saves and saves the queues a last time. It
+// does nothing for queues created without a snapshot.
+func (q *MemQueue) Release() error {
+	if q.snapshot.Path == "" {
+		return nil
+	}
+	q.once.Do(func() {
+		close(q.done)
+	})
+
+	return q.Save(q.snapshot.Path)
+}
+
+// Save writes every queue along with its pause state and counters to the
+// file at path. The file is replaced atomically, so a crash while saving
+// leaves the previous snapshot intact.
+func (q *MemQueue) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := q.WriteSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore replaces every queue with those saved in the file at path.
+func (q *MemQueue) Restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return q.ReadSnapshot(f)
+}
+
+// WriteSnapshot writes every queue to w as JSON.
+func (q *MemQueue) WriteSnapshot(w io.Writer) error {
+	q.lock.RLock()
+	s := snapshot{Version: snapshotVersion, Queues: make(map[string]snapshotQueue)}
+	for queue, items := range q.data {
+		s.Queues[queue] = snapshotQueue{Tasks: items}
+	}
+	for queue := range q.paused {
+		sq := s.Queues[queue]
+		sq.Paused = true
+		s.Queues[queue] = sq
+	}
+	for queue, enqueued := range q.enqueued {
+		sq := s.Queues[queue]
+		sq.Enqueued, sq.Dequeued = enqueued, q.dequeued[queue]
+		s.Queues[queue] = sq
+	}
+	data, err := json.Marshal(s)
+	q.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadSnapshot replaces every queue with those of a snapshot written by
+// WriteSnapshot.
+func (q *MemQueue) ReadSnapshot(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.data = make(map[string][]tq.Message)
+	q.paused = make(map[string]bool)
+	q.enqueued = make(map[string]int64)
+	q.dequeued = make(map[string]int64)
+	for _, sq := range s.Queues {
+		for _, task := range sq.Tasks {
+			if seq, err := strconv.ParseUint(task.ID, 10, 64); err == nil && seq > q.seq {
+				q.seq = seq
+			}
+		}
+	}
+	for queue, sq := range s.Queues {
+		// tasks saved without an ID get one so they can be removed by ID.
+		for i := range sq.Tasks {
+			if sq.Tasks[i].ID == "" {
+				q.seq++
+				sq.Tasks[i].ID = strconv.FormatUint(q.seq, 10)
+			}
+		}
+		if len(sq.Tasks) > 0 {
+			q.data[queue] = sq.Tasks
+		}
+		if sq.Paused {
+			q.paused[queue] = true
+		}
+		if sq.Enqueued > 0 {
+			q.enqueued[queue] = sq.Enqueued
+			q.dequeued[queue] = sq.Dequeued
+		}
+	}
+	q.blocked.Broadcast()
+
+	return nil
+}
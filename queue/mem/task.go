@@ -1,123 +1,421 @@
 package mem
 
 import (
+	"context"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	tq "github.com/ZutrixPog/dispatcher/queue"
 )
 
+// Deprecated: the dispatcher spawns background tasks to queue.BgQueue.
+// BgChannel is still left unlimited unless given a limit with
+// queue.WithLimit.
 const BgChannel = "bg-channel"
 
 var _ tq.TaskQueue = (*MemQueue)(nil)
 
+// MemQueue keeps every queue as a slice sorted in pop order.
 type MemQueue struct {
-	data    map[string][]string
-	blocked map[string]*sync.Cond
-	limit   int64
-	lock    sync.RWMutex
+	data     map[string][]tq.Message
+	paused   map[string]bool
+	enqueued map[string]int64
+	dequeued map[string]int64
+	blocked  *sync.Cond
+	limit    int64
+	config   tq.Config
+	seq      uint64
+	lock     sync.RWMutex
+	snapshot Snapshot
+	done     chan struct{}
+	once     sync.Once
 }
 
-func NewQueue(limit int64) tq.TaskQueue {
-	return &MemQueue{
-		data:    make(map[string][]string),
-		blocked: make(map[string]*sync.Cond),
-		limit:   limit,
+func NewQueue(limit int64, opts ...tq.Option) tq.TaskQueue {
+	q := &MemQueue{
+		data:     make(map[string][]tq.Message),
+		paused:   make(map[string]bool),
+		enqueued: make(map[string]int64),
+		dequeued: make(map[string]int64),
+		limit:    limit,
+		config:   tq.NewConfig(append([]tq.Option{tq.WithLimit(BgChannel, 0)}, opts...)...),
+		done:     make(chan struct{}),
 	}
+	q.blocked = sync.NewCond(&q.lock)
+
+	return q
 }
 
-func (q *MemQueue) Push(queue string, ts []byte) (int, error) {
+func (q *MemQueue) Push(ctx context.Context, queue string, ts tq.Message) (int, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	if len(q.data[queue]) >= int(q.limit) && queue != BgChannel {
-		return 0, tq.ErrFullQueue
+	if q.config.Full(queue, len(q.data[queue]), 1, q.limit) {
+		switch q.config.Overflow(queue) {
+		case tq.Block:
+			if err := q.waitRoom(ctx, queue); err != nil {
+				return 0, err
+			}
+		case tq.DropOldest:
+			q.dropOldest(queue)
+		default:
+			return 0, tq.ErrFullQueue
+		}
 	}
 
-	q.data[queue] = append(q.data[queue], string(ts))
-	if _, ok := q.blocked[queue]; ok {
-		q.blocked[queue].Signal()
+	return q.push(queue, ts), nil
+}
+
+func (q *MemQueue) Requeue(ctx context.Context, queue string, ts tq.Message) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.push(queue, ts)
+	return nil
+}
+
+// waitRoom waits with the lock held until the queue can take a task or ctx
+// is done.
+func (q *MemQueue) waitRoom(ctx context.Context, queue string) error {
+	defer q.wakeOnDone(ctx)()
+
+	for q.config.Full(queue, len(q.data[queue]), 1, q.limit) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.blocked.Wait()
 	}
-	return len(q.data[queue]) - 1, nil
+
+	return nil
 }
 
-func (q *MemQueue) Pop(queue string) ([]byte, error) {
+// wakeOnDone wakes the waiters when ctx is done, so that a wait on blocked
+// gives up with it, until the returned function is called.
+func (q *MemQueue) wakeOnDone(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.lock.Lock()
+			q.blocked.Broadcast()
+			q.lock.Unlock()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// dropOldest removes the oldest task of the lowest priority in the queue.
+func (q *MemQueue) dropOldest(queue string) {
+	items := q.data[queue]
+	if len(items) == 0 {
+		return
+	}
+
+	index := len(items) - 1
+	if q.config.Order(queue) == tq.FIFO {
+		lowest := items[index].Priority
+		index = sort.Search(len(items), func(i int) bool {
+			return items[i].Priority <= lowest
+		})
+	}
+	q.data[queue] = append(items[:index:index], items[index+1:]...)
+}
+
+func (q *MemQueue) push(queue string, ts tq.Message) int {
+	items := q.data[queue]
+	q.seq++
+	ts.ID = strconv.FormatUint(q.seq, 10)
+	ts.Queue = queue
+	ts.Enqueued = time.Now()
+	ts.Data = append([]byte{}, ts.Data...)
+	lifo := q.config.Order(queue) == tq.LIFO
+	index := sort.Search(len(items), func(i int) bool {
+		return items[i].Priority < ts.Priority || lifo && items[i].Priority == ts.Priority
+	})
+	items = append(items, tq.Message{})
+	copy(items[index+1:], items[index:])
+	items[index] = ts
+	q.data[queue] = items
+	q.enqueued[queue]++
+
+	q.blocked.Broadcast()
+	return index
+}
+
+func (q *MemQueue) Pop(ctx context.Context, queue string) (tq.Message, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	if q.paused[queue] {
+		return tq.Message{}, tq.ErrQueuePaused
+	}
 	if len(q.data[queue]) == 0 {
+		return tq.Message{}, tq.ErrEmptyQueue
+	}
+
+	return q.pop(queue), nil
+}
+
+func (q *MemQueue) PopN(ctx context.Context, queue string, n int) ([]tq.Message, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.paused[queue] {
+		return nil, tq.ErrQueuePaused
+	}
+	items := q.data[queue]
+	if len(items) == 0 {
 		return nil, tq.ErrEmptyQueue
 	}
+	if n > len(items) {
+		n = len(items)
+	}
 
-	item := q.data[queue][len(q.data[queue])-1]
-	q.data[queue] = q.data[queue][:len(q.data[queue])-1]
+	popped := make([]tq.Message, n)
+	copy(popped, items)
+	q.data[queue] = items[n:]
+	q.dequeued[queue] += int64(n)
+	q.blocked.Broadcast()
 
-	return []byte(item), nil
+	return popped, nil
 }
 
-func (q *MemQueue) BlockingPop(queue string) <-chan []byte {
-	waitchan := make(chan []byte)
-	go func() {
-		q.lock.Lock()
-		defer q.lock.Unlock()
-		for len(q.data[queue]) == 0 {
-			q.blocked[queue] = sync.NewCond(&q.lock)
-			q.blocked[queue].Wait()
+func (q *MemQueue) PopFilter(ctx context.Context, queue string, filter tq.Filter) (tq.Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.paused[queue] {
+		return tq.Message{}, tq.ErrQueuePaused
+	}
+
+	items := q.data[queue]
+	for i := range items {
+		if filter.Match(items[i]) {
+			item := items[i]
+			q.data[queue] = append(items[:i:i], items[i+1:]...)
+			q.dequeued[queue]++
+			q.blocked.Broadcast()
+
+			return item, nil
 		}
+	}
 
-		item := q.data[queue][len(q.data[queue])-1]
-		q.data[queue] = q.data[queue][:len(q.data[queue])-1]
-		waitchan <- []byte(item)
-	}()
+	return tq.Message{}, tq.ErrEmptyQueue
+}
+
+func (q *MemQueue) BlockingPop(ctx context.Context, queues ...string) (tq.Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.wakeOnDone(ctx)()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return tq.Message{}, err
+		}
+		if queue, ok := q.ready(queues); ok {
+			return q.pop(queue), nil
+		}
+		q.blocked.Wait()
+	}
+}
 
-	return waitchan
+// ready returns the first of the queues that has a task and is not paused.
+func (q *MemQueue) ready(queues []string) (string, bool) {
+	for _, queue := range queues {
+		if len(q.data[queue]) > 0 && !q.paused[queue] {
+			return queue, true
+		}
+	}
+
+	return "", false
 }
 
-func (q *MemQueue) Get(queue string, index int) ([]byte, error) {
+func (q *MemQueue) pop(queue string) tq.Message {
+	item := q.data[queue][0]
+	q.data[queue] = q.data[queue][1:]
+	q.dequeued[queue]++
+	q.blocked.Broadcast()
+
+	return item
+}
+
+func (q *MemQueue) Get(ctx context.Context, queue string, index int) (tq.Message, error) {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
 
 	if index < 0 || index >= len(q.data[queue]) {
-		return nil, tq.ErrEntityNotFound
+		return tq.Message{}, tq.ErrEntityNotFound
 	}
 
-	item := q.data[queue][index]
-	return []byte(item), nil
+	return q.data[queue][index], nil
 }
 
-func (q *MemQueue) List(queue string) ([][]byte, error) {
+func (q *MemQueue) List(ctx context.Context, queue string, page tq.Page) ([]tq.Message, error) {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
 
-	items := q.data[queue]
-	if len(items) == 0 {
-		return nil, tq.ErrEmptyQueue
+	var result []tq.Message
+	skipped := 0
+	for _, item := range q.data[queue] {
+		if page.Full(len(result)) {
+			break
+		}
+		if !page.Match(item) {
+			continue
+		}
+		if skipped < page.Offset {
+			skipped++
+			continue
+		}
+		result = append(result, item)
 	}
-
-	result := make([][]byte, len(items))
-	for i, item := range items {
-		result[i] = []byte(item)
+	if len(result) == 0 {
+		return nil, tq.ErrEmptyQueue
 	}
 
 	return result, nil
 }
 
-func (q *MemQueue) Remove(queue string, index int) error {
+func (q *MemQueue) Remove(ctx context.Context, queue string, index int) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	if index < 0 || index >= len(q.data[queue]) {
+	items := q.data[queue]
+	if index < 0 || index >= len(items) {
 		return tq.ErrEntityNotFound
 	}
 
-	q.data[queue][index] = "DELETED"
+	q.data[queue] = append(items[:index:index], items[index+1:]...)
+	q.blocked.Broadcast()
 
-	cleanData := []string{}
-	for _, item := range q.data[queue] {
-		if item != "DELETED" {
-			cleanData = append(cleanData, item)
+	return nil
+}
+
+func (q *MemQueue) RemoveID(ctx context.Context, queue string, id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	items := q.data[queue]
+	for index, item := range items {
+		if item.ID == id {
+			q.data[queue] = append(items[:index:index], items[index+1:]...)
+			q.blocked.Broadcast()
+			return nil
 		}
 	}
-	q.data[queue] = cleanData
 
+	return tq.ErrEntityNotFound
+}
+
+func (q *MemQueue) Pause(ctx context.Context, queue string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.paused[queue] = true
+	return nil
+}
+
+func (q *MemQueue) Resume(ctx context.Context, queue string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.paused, queue)
+	q.blocked.Broadcast()
 	return nil
 }
+
+func (q *MemQueue) Paused(ctx context.Context, queue string) (bool, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.paused[queue], nil
+}
+
+func (q *MemQueue) Delete(ctx context.Context, queue string, filter tq.Filter) ([]tq.Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.delete(queue, filter), nil
+}
+
+func (q *MemQueue) Move(ctx context.Context, from, to string, filter tq.Filter) ([]tq.Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	matched := 0
+	for _, item := range q.data[from] {
+		if filter.Match(item) {
+			matched++
+		}
+	}
+	if from == to || matched == 0 {
+		return nil, nil
+	}
+	if q.config.Full(to, len(q.data[to]), matched, q.limit) {
+		return nil, tq.ErrFullQueue
+	}
+
+	moved := q.delete(from, filter)
+	for _, item := range moved {
+		q.push(to, item)
+	}
+
+	return moved, nil
+}
+
+func (q *MemQueue) delete(queue string, filter tq.Filter) []tq.Message {
+	var removed, kept []tq.Message
+	for _, item := range q.data[queue] {
+		if filter.Match(item) {
+			removed = append(removed, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	q.data[queue] = kept
+	q.blocked.Broadcast()
+
+	return removed
+}
+
+func (q *MemQueue) ListQueues(ctx context.Context) ([]string, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	queues := make([]string, 0, len(q.enqueued))
+	for queue := range q.enqueued {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+
+	return queues, nil
+}
+
+func (q *MemQueue) QueueStats(ctx context.Context, queue string) (tq.Stats, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	stats := tq.Stats{
+		Queue:    queue,
+		Length:   len(q.data[queue]),
+		Paused:   q.paused[queue],
+		Enqueued: q.enqueued[queue],
+		Dequeued: q.dequeued[queue],
+		At:       time.Now(),
+	}
+	for _, item := range q.data[queue] {
+		if stats.Oldest.IsZero() || item.Enqueued.Before(stats.Oldest) {
+			stats.Oldest = item.Enqueued
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,86 @@
+package mem_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/mem"
+	"github.com/ZutrixPog/dispatcher/queue/queuetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemQueue_Conformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		return mem.NewQueue(limit, opts...)
+	})
+}
+
+func TestMemQueue_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.json")
+	q, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path}, 10)
+	require.NoError(t, err)
+
+	for _, priority := range []int{0, 2, 1} {
+		_, err := q.Push(context.Background(), "snapshot", tq.Message{Type: "dummy", Headers: map[string]string{"tenant": "acme"}, Priority: priority, Data: []byte{byte(priority)}})
+		require.NoError(t, err)
+	}
+	_, err = q.Pop(context.Background(), "snapshot")
+	require.NoError(t, err)
+	require.NoError(t, q.Pause(context.Background(), "paused"))
+	before, err := q.List(context.Background(), "snapshot", tq.Page{})
+	require.NoError(t, err)
+	require.NoError(t, q.Release())
+
+	restored, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path}, 10)
+	require.NoError(t, err)
+	after, err := restored.List(context.Background(), "snapshot", tq.Page{})
+	require.NoError(t, err)
+	require.Len(t, after, 2)
+	for i := range before {
+		require.Equal(t, before[i].Data, after[i].Data, "tasks keep their pop order")
+		require.Equal(t, before[i].Headers, after[i].Headers)
+		require.True(t, before[i].Enqueued.Equal(after[i].Enqueued))
+	}
+
+	paused, err := restored.Paused(context.Background(), "paused")
+	require.NoError(t, err)
+	require.True(t, paused)
+	stats, err := restored.QueueStats(context.Background(), "snapshot")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), stats.Enqueued)
+	require.Equal(t, int64(1), stats.Dequeued)
+}
+
+func TestMemQueue_SnapshotInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.json")
+	q, err := mem.NewSnapshotQueue(mem.Snapshot{Path: path, Interval: 10 * time.Millisecond}, 10)
+	require.NoError(t, err)
+	defer q.Release()
+
+	_, err = q.Push(context.Background(), "snapshot", tq.Message{Data: []byte("a")})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		restored := mem.NewQueue(10).(*mem.MemQueue)
+		if restored.Restore(path) != nil {
+			return false
+		}
+		_, err := restored.Pop(context.Background(), "snapshot")
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "the queues are saved in the background")
+}
+
+func TestMemQueue_SnapshotMissing(t *testing.T) {
+	q, err := mem.NewSnapshotQueue(mem.Snapshot{Path: filepath.Join(t.TempDir(), "queues.json")}, 10)
+	require.NoError(t, err, "a missing snapshot starts empty")
+
+	_, err = q.Pop(context.Background(), "snapshot")
+	require.ErrorIs(t, err, tq.ErrEmptyQueue)
+
+	err = q.ReadSnapshot(strings.NewReader(`{"version": 99}`))
+	require.ErrorIs(t, err, mem.ErrSnapshotVersion)
+}
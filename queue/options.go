@@ -0,0 +1,117 @@
+package queue
+
+// Order is the order in which tasks of the same priority are popped.
+type Order int
+
+const (
+	// FIFO pops the oldest task of a priority first. It is the default.
+	FIFO Order = iota
+	// LIFO pops the newest task of a priority first.
+	LIFO
+)
+
+// Overflow is what a push to a full queue does.
+type Overflow int
+
+const (
+	// Reject fails the push with ErrFullQueue. It is the default.
+	Reject Overflow = iota
+	// Block waits until the queue has room or the context of the push is
+	// done.
+	Block
+	// DropOldest drops the oldest task of the lowest priority in the queue
+	// to make room.
+	DropOldest
+)
+
+// BgQueue is the queue the dispatcher spawns background tasks to. Like the
+// earlier versions, every backend leaves it unlimited unless it is given a
+// limit with WithLimit.
+const BgQueue = "bg-queue"
+
+// Option configures the queues of a TaskQueue backend.
+type Option func(*Config)
+
+// Config holds the per queue settings every backend understands. Backends
+// sharing storage across processes must be configured alike.
+type Config struct {
+	orders    map[string]Order
+	limits    map[string]int64
+	overflows map[string]Overflow
+	namespace string
+}
+
+func NewConfig(opts ...Option) Config {
+	config := Config{
+		orders:    make(map[string]Order),
+		limits:    make(map[string]int64),
+		overflows: make(map[string]Overflow),
+	}
+	config.limits[BgQueue] = 0
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return config
+}
+
+// WithOrder sets the order of the named queue.
+func WithOrder(queue string, order Order) Option {
+	return func(c *Config) {
+		c.orders[queue] = order
+	}
+}
+
+// WithLimit overrides the limit the backend was created with for the named
+// queue. A limit of 0 or less leaves the queue unlimited.
+func WithLimit(queue string, limit int64) Option {
+	return func(c *Config) {
+		c.limits[queue] = limit
+	}
+}
+
+// WithOverflow sets what a push to the named queue does when it is full.
+func WithOverflow(queue string, overflow Overflow) Option {
+	return func(c *Config) {
+		c.overflows[queue] = overflow
+	}
+}
+
+// WithNamespace keeps the queues apart from those of other namespaces in
+// the same storage, so several services can share it. Backends keeping
+// queues in process memory ignore it.
+func WithNamespace(namespace string) Option {
+	return func(c *Config) {
+		c.namespace = namespace
+	}
+}
+
+func (c Config) Order(queue string) Order {
+	return c.orders[queue]
+}
+
+// Limit returns the limit of the queue, or the given default limit when it
+// has none of its own.
+func (c Config) Limit(queue string, limit int64) int64 {
+	if l, ok := c.limits[queue]; ok {
+		return l
+	}
+
+	return limit
+}
+
+// Full reports whether a queue holding length tasks can not take another n
+// under its limit.
+func (c Config) Full(queue string, length, n int, limit int64) bool {
+	limit = c.Limit(queue, limit)
+
+	return limit > 0 && int64(length+n) > limit
+}
+
+func (c Config) Overflow(queue string) Overflow {
+	return c.overflows[queue]
+}
+
+func (c Config) Namespace() string {
+	return c.namespace
+}
@@ -0,0 +1,713 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// channel is notified whenever a task is pushed or a queue resumed.
+	channel      = "dispatcher_queue"
+	popTimeout   = time.Second
+	pushInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrMigration = errors.New("queue migration failed")
+
+	errNoListen = errors.New("the database driver does not support LISTEN")
+)
+
+var (
+	_ tq.TaskQueue = (*Queue)(nil)
+	_ tq.Releaser  = (*Queue)(nil)
+)
+
+// Queue keeps tasks as rows of the queue_tasks table, one row per task, and
+// the pause state and counters of every queue in queue_states. Pops delete
+// the next row with FOR UPDATE SKIP LOCKED, so concurrent consumers never
+// wait on each other, while pushes lock the state row of their queue so
+// that its limit holds.
+type Queue struct {
+	db       *gorm.DB
+	limit    int64
+	config   tq.Config
+	listener *listener
+}
+
+func NewTaskQueue(db *gorm.DB, limit int64, opts ...tq.Option) tq.TaskQueue {
+	return &Queue{db, limit, tq.NewConfig(opts...), newListener(db)}
+}
+
+// Release stops listening for notifications and closes the connection held
+// for it. Blocked pops of a released queue fall back to polling.
+func (q *Queue) Release() error {
+	q.listener.release()
+	return nil
+}
+
+// InTx returns a view of the queue whose operations run within the
+// transaction, so tasks can be pushed or popped atomically with other
+// changes to the database.
+func (q *Queue) InTx(tx *gorm.DB) tq.TaskQueue {
+	return &Queue{tx, q.limit, q.config, q.listener}
+}
+
+// Migrate creates the tables of the queue. It can be passed to InitDB of
+// the history package to migrate both at once.
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&task{}, &state{}); err != nil {
+		return ErrMigration
+	}
+	return nil
+}
+
+type task struct {
+	ID        int64     `gorm:"primaryKey"`
+	Namespace string    `gorm:"not null;index:idx_queue_tasks_order,priority:1"`
+	Queue     string    `gorm:"not null;index:idx_queue_tasks_order,priority:2"`
+	Priority  int       `gorm:"not null;index:idx_queue_tasks_order,priority:3"`
+	Type      string    `gorm:"not null"`
+	Headers   string    `gorm:"type:jsonb;not null"`
+	Enqueued  time.Time `gorm:"not null"`
+	Data      []byte    `gorm:"not null"`
+}
+
+func (task) TableName() string {
+	return "queue_tasks"
+}
+
+type state struct {
+	Namespace string `gorm:"primaryKey"`
+	Queue     string `gorm:"primaryKey"`
+	Paused    bool   `gorm:"not null;default:false"`
+	Enqueued  int64  `gorm:"not null;default:0"`
+	Dequeued  int64  `gorm:"not null;default:0"`
+}
+
+func (state) TableName() string {
+	return "queue_states"
+}
+
+// Push polls a full queue with the Block overflow policy until it has room.
+func (q *Queue) Push(ctx context.Context, queue string, ts tq.Message) (int, error) {
+	for {
+		index, err := q.push(ctx, queue, ts, true)
+		if err != nil && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != tq.ErrFullQueue || q.config.Overflow(queue) != tq.Block {
+			return index, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(pushInterval):
+		}
+	}
+}
+
+func (q *Queue) Requeue(ctx context.Context, queue string, ts tq.Message) error {
+	_, err := q.push(ctx, queue, ts, false)
+	return err
+}
+
+// push pushes a task, under the limit of the queue when bounded.
+func (q *Queue) push(ctx context.Context, queue string, ts tq.Message, bounded bool) (int, error) {
+	var index int64
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := q.lock(tx, queue); err != nil {
+			return err
+		}
+
+		cond, args := q.where(queue, tq.Filter{})
+		var length int64
+		if err := tx.Model(&task{}).Where(cond, args...).Count(&length).Error; err != nil {
+			return err
+		}
+		if bounded && q.config.Full(queue, int(length), 1, q.limit) {
+			if q.config.Overflow(queue) != tq.DropOldest {
+				return tq.ErrFullQueue
+			}
+
+			// the oldest task has the smallest ID whatever the order.
+			dropped := tx.Exec(`DELETE FROM queue_tasks WHERE id = (
+				SELECT id FROM queue_tasks WHERE `+cond+`
+				ORDER BY priority ASC, id ASC LIMIT 1 FOR UPDATE SKIP LOCKED
+			)`, args...)
+			if dropped.Error != nil {
+				return dropped.Error
+			}
+			if dropped.RowsAffected == 0 {
+				return tq.ErrFullQueue
+			}
+		}
+
+		before := "priority >= ?"
+		if q.config.Order(queue) == tq.LIFO {
+			before = "priority > ?"
+		}
+		if err := tx.Model(&task{}).Where(cond, args...).Where(before, ts.Priority).Count(&index).Error; err != nil {
+			return err
+		}
+
+		return q.insert(tx, queue, ts)
+	})
+	if err == tq.ErrFullQueue {
+		return 0, err
+	}
+	if err != nil {
+		return 0, tq.ErrCreateEntity
+	}
+
+	return int(index), nil
+}
+
+func (q *Queue) Pop(ctx context.Context, queue string) (tq.Message, error) {
+	return q.pop(ctx, queue, tq.Filter{})
+}
+
+func (q *Queue) PopFilter(ctx context.Context, queue string, filter tq.Filter) (tq.Message, error) {
+	return q.pop(ctx, queue, filter)
+}
+
+// PopN pops the tasks in a single statement, so a batch takes one round trip.
+func (q *Queue) PopN(ctx context.Context, queue string, n int) ([]tq.Message, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	rows, err := q.popN(ctx, queue, tq.Filter{}, n)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]tq.Message, len(rows))
+	for i := range rows {
+		tasks[i] = rows[i].message()
+	}
+	return tasks, nil
+}
+
+func (q *Queue) pop(ctx context.Context, queue string, filter tq.Filter) (tq.Message, error) {
+	rows, err := q.popN(ctx, queue, filter, 1)
+	if err != nil {
+		return tq.Message{}, err
+	}
+
+	return rows[0].message(), nil
+}
+
+// popN deletes the first n matching rows that no other transaction has
+// locked and counts them as dequeued in a single statement.
+func (q *Queue) popN(ctx context.Context, queue string, filter tq.Filter, n int) ([]task, error) {
+	cond, args := q.where(queue, filter)
+	args = append(args, q.config.Namespace(), queue, n, q.config.Namespace(), queue)
+
+	var rows []task
+	err := q.db.WithContext(ctx).Raw(`WITH popped AS (
+		DELETE FROM queue_tasks WHERE id IN (
+			SELECT id FROM queue_tasks WHERE `+cond+` AND NOT EXISTS (
+				SELECT 1 FROM queue_states s WHERE s.namespace = ? AND s.queue = ? AND s.paused
+			)
+			ORDER BY `+q.order(queue)+` LIMIT ? FOR UPDATE SKIP LOCKED
+		) RETURNING *
+	), counted AS (
+		UPDATE queue_states SET dequeued = dequeued + (SELECT count(*) FROM popped)
+		WHERE namespace = ? AND queue = ? AND EXISTS (SELECT 1 FROM popped)
+	)
+	SELECT * FROM popped`, args...).Scan(&rows).Error
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	if len(rows) == 0 {
+		if paused, _ := q.Paused(ctx, queue); paused {
+			return nil, tq.ErrQueuePaused
+		}
+		return nil, tq.ErrEmptyQueue
+	}
+
+	q.sort(queue, rows)
+	return rows, nil
+}
+
+// BlockingPop tries the queues in order and, when they are all empty, waits
+// for a task to be pushed to any queue. Notifications only cut the wait
+// short, so the wait is bounded in case one is missed.
+func (q *Queue) BlockingPop(ctx context.Context, queues ...string) (tq.Message, error) {
+	for {
+		wake, timeout := q.listener.wait()
+		if err := ctx.Err(); err != nil {
+			return tq.Message{}, err
+		}
+		for _, queue := range queues {
+			// a pop cancelled halfway could delete a task without returning
+			// it, so only the wait is cancelled.
+			ts, err := q.pop(context.Background(), queue, tq.Filter{})
+			if err != tq.ErrEmptyQueue && err != tq.ErrQueuePaused {
+				return ts, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return tq.Message{}, ctx.Err()
+		case <-wake:
+		case <-time.After(timeout):
+		}
+	}
+}
+
+func (q *Queue) Get(ctx context.Context, queue string, index int) (tq.Message, error) {
+	if index < 0 {
+		return tq.Message{}, tq.ErrEntityNotFound
+	}
+
+	cond, args := q.where(queue, tq.Filter{})
+	var rows []task
+	err := q.db.WithContext(ctx).Where(cond, args...).Order(q.order(queue)).Offset(index).Limit(1).Find(&rows).Error
+	if err != nil {
+		return tq.Message{}, tq.ErrRetrieveEntity
+	}
+	if len(rows) == 0 {
+		return tq.Message{}, tq.ErrEntityNotFound
+	}
+
+	return rows[0].message(), nil
+}
+
+func (q *Queue) List(ctx context.Context, queue string, page tq.Page) ([]tq.Message, error) {
+	cond, args := q.where(queue, page.Filter)
+	query := q.db.WithContext(ctx).Where(cond, args...).Order(q.order(queue))
+	if !page.Before.IsZero() {
+		query = query.Where("enqueued < ?", page.Before)
+	}
+	if !page.After.IsZero() {
+		query = query.Where("enqueued > ?", page.After)
+	}
+	if page.Offset > 0 {
+		query = query.Offset(page.Offset)
+	}
+	if page.Limit > 0 {
+		query = query.Limit(page.Limit)
+	}
+
+	var rows []task
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+	if len(rows) == 0 {
+		return nil, tq.ErrEmptyQueue
+	}
+
+	return messages(rows), nil
+}
+
+func (q *Queue) Remove(ctx context.Context, queue string, index int) error {
+	if index < 0 {
+		return tq.ErrEntityNotFound
+	}
+
+	cond, args := q.where(queue, tq.Filter{})
+	res := q.db.WithContext(ctx).Exec(`DELETE FROM queue_tasks WHERE id = (
+		SELECT id FROM queue_tasks WHERE `+cond+` ORDER BY `+q.order(queue)+` OFFSET ? LIMIT 1
+	)`, append(args, index)...)
+	if res.Error != nil {
+		return tq.ErrRemoveEntity
+	}
+	if res.RowsAffected == 0 {
+		return tq.ErrEntityNotFound
+	}
+
+	return nil
+}
+
+func (q *Queue) RemoveID(ctx context.Context, queue string, id string) error {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return tq.ErrEntityNotFound
+	}
+
+	cond, args := q.where(queue, tq.Filter{})
+	res := q.db.WithContext(ctx).Exec(`DELETE FROM queue_tasks WHERE id = ? AND `+cond, append([]interface{}{rowID}, args...)...)
+	if res.Error != nil {
+		return tq.ErrRemoveEntity
+	}
+	if res.RowsAffected == 0 {
+		return tq.ErrEntityNotFound
+	}
+
+	return nil
+}
+
+func (q *Queue) Pause(ctx context.Context, queue string) error {
+	err := q.db.WithContext(ctx).Exec(`INSERT INTO queue_states (namespace, queue, paused) VALUES (?, ?, true)
+		ON CONFLICT (namespace, queue) DO UPDATE SET paused = true`, q.config.Namespace(), queue).Error
+	if err != nil {
+		return tq.ErrCreateEntity
+	}
+
+	return nil
+}
+
+func (q *Queue) Resume(ctx context.Context, queue string) error {
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&state{}).Where("namespace = ? AND queue = ?", q.config.Namespace(), queue).
+			Update("paused", false).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec("SELECT pg_notify(?, ?)", channel, queue).Error
+	})
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+
+	return nil
+}
+
+func (q *Queue) Paused(ctx context.Context, queue string) (bool, error) {
+	var states []state
+	err := q.db.WithContext(ctx).Where("namespace = ? AND queue = ?", q.config.Namespace(), queue).Limit(1).Find(&states).Error
+	if err != nil {
+		return false, tq.ErrRetrieveEntity
+	}
+
+	return len(states) > 0 && states[0].Paused, nil
+}
+
+func (q *Queue) Delete(ctx context.Context, queue string, filter tq.Filter) ([]tq.Message, error) {
+	var rows []task
+	cond, args := q.where(queue, filter)
+	err := q.db.WithContext(ctx).Raw(`DELETE FROM queue_tasks WHERE `+cond+` RETURNING *`, args...).Scan(&rows).Error
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+	q.sort(queue, rows)
+
+	return messages(rows), nil
+}
+
+func (q *Queue) Move(ctx context.Context, from, to string, filter tq.Filter) ([]tq.Message, error) {
+	if from == to {
+		return nil, nil
+	}
+
+	var rows []task
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := q.lock(tx, to); err != nil {
+			return err
+		}
+
+		cond, args := q.where(from, filter)
+		err := tx.Raw(`DELETE FROM queue_tasks WHERE `+cond+` RETURNING *`, args...).Scan(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+
+		cond, args = q.where(to, tq.Filter{})
+		var length int64
+		if err := tx.Model(&task{}).Where(cond, args...).Count(&length).Error; err != nil {
+			return err
+		}
+		if q.config.Full(to, int(length), len(rows), q.limit) {
+			return tq.ErrFullQueue
+		}
+
+		q.sort(from, rows)
+		for _, row := range rows {
+			if err := q.insert(tx, to, row.message()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == tq.ErrFullQueue {
+		return nil, err
+	}
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return messages(rows), nil
+}
+
+func (q *Queue) ListQueues(ctx context.Context) ([]string, error) {
+	queues := make([]string, 0)
+	err := q.db.WithContext(ctx).Model(&state{}).Where("namespace = ? AND enqueued > 0", q.config.Namespace()).
+		Order("queue").Pluck("queue", &queues).Error
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	return queues, nil
+}
+
+func (q *Queue) QueueStats(ctx context.Context, queue string) (tq.Stats, error) {
+	var tasks struct {
+		Length int
+		Oldest *time.Time
+	}
+	cond, args := q.where(queue, tq.Filter{})
+	err := q.db.WithContext(ctx).Model(&task{}).Select("count(*) AS length, min(enqueued) AS oldest").
+		Where(cond, args...).Scan(&tasks).Error
+	if err != nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+
+	var states []state
+	err = q.db.WithContext(ctx).Where("namespace = ? AND queue = ?", q.config.Namespace(), queue).Limit(1).Find(&states).Error
+	if err != nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+
+	stats := tq.Stats{Queue: queue, Length: tasks.Length, At: time.Now()}
+	if tasks.Oldest != nil {
+		stats.Oldest = *tasks.Oldest
+	}
+	if len(states) > 0 {
+		stats.Paused, stats.Enqueued, stats.Dequeued = states[0].Paused, states[0].Enqueued, states[0].Dequeued
+	}
+
+	return stats, nil
+}
+
+// lock creates the state row of the queue if needed and locks it until the
+// transaction ends, so that pushes to the queue take turns.
+func (q *Queue) lock(tx *gorm.DB, queue string) error {
+	err := tx.Exec(`INSERT INTO queue_states (namespace, queue) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+		q.config.Namespace(), queue).Error
+	if err != nil {
+		return err
+	}
+
+	var locked []state
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("namespace = ? AND queue = ?", q.config.Namespace(), queue).Find(&locked).Error
+}
+
+// insert adds a task to the queue and notifies the listeners once the
+// transaction commits.
+func (q *Queue) insert(tx *gorm.DB, queue string, ts tq.Message) error {
+	headers, _ := json.Marshal(ts.Headers)
+	if len(ts.Headers) == 0 {
+		headers = []byte("{}")
+	}
+	row := task{
+		Namespace: q.config.Namespace(),
+		Queue:     queue,
+		Priority:  ts.Priority,
+		Type:      ts.Type,
+		Headers:   string(headers),
+		Enqueued:  time.Now(),
+		Data:      append([]byte{}, ts.Data...),
+	}
+	if err := tx.Create(&row).Error; err != nil {
+		return err
+	}
+
+	err := tx.Model(&state{}).Where("namespace = ? AND queue = ?", q.config.Namespace(), queue).
+		Update("enqueued", gorm.Expr("enqueued + 1")).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Exec("SELECT pg_notify(?, ?)", channel, queue).Error
+}
+
+// where returns the conditions selecting the tasks of the queue that match
+// the filter, along with their arguments.
+func (q *Queue) where(queue string, filter tq.Filter) (string, []interface{}) {
+	cond := "namespace = ? AND queue = ?"
+	args := []interface{}{q.config.Namespace(), queue}
+	if filter.Type != "" {
+		cond += " AND type = ?"
+		args = append(args, filter.Type)
+	}
+	if len(filter.Headers) > 0 {
+		headers, _ := json.Marshal(filter.Headers)
+		cond += " AND headers @> CAST(? AS jsonb)"
+		args = append(args, string(headers))
+	}
+
+	return cond, args
+}
+
+// order returns the ORDER BY clause of the pop order of the queue. IDs grow
+// with every push, so they order the tasks of a priority by age.
+func (q *Queue) order(queue string) string {
+	if q.config.Order(queue) == tq.LIFO {
+		return "priority DESC, id DESC"
+	}
+	return "priority DESC, id ASC"
+}
+
+// sort sorts rows returned in no particular order into the pop order of the
+// queue.
+func (q *Queue) sort(queue string, rows []task) {
+	lifo := q.config.Order(queue) == tq.LIFO
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Priority != rows[j].Priority {
+			return rows[i].Priority > rows[j].Priority
+		}
+		if lifo {
+			return rows[i].ID > rows[j].ID
+		}
+		return rows[i].ID < rows[j].ID
+	})
+}
+
+func (t task) message() tq.Message {
+	ts := tq.Message{
+		ID:       strconv.FormatInt(t.ID, 10),
+		Queue:    t.Queue,
+		Type:     t.Type,
+		Priority: t.Priority,
+		Enqueued: t.Enqueued,
+		Data:     t.Data,
+	}
+	if ts.Data == nil {
+		ts.Data = []byte{}
+	}
+	if json.Unmarshal([]byte(t.Headers), &ts.Headers) != nil || len(ts.Headers) == 0 {
+		ts.Headers = nil
+	}
+
+	return ts
+}
+
+func messages(rows []task) []tq.Message {
+	msgs := make([]tq.Message, len(rows))
+	for i := range rows {
+		msgs[i] = rows[i].message()
+	}
+
+	return msgs
+}
+
+// listener holds a connection listening on the channel and wakes every
+// blocked pop when a notification arrives. Without a pgx connection to
+// listen on, blocked pops fall back to polling.
+type listener struct {
+	db        *gorm.DB
+	ctx       context.Context
+	cancel    context.CancelFunc
+	once      sync.Once
+	done      sync.WaitGroup
+	lock      sync.Mutex
+	wake      chan struct{}
+	listening bool
+}
+
+func newListener(db *gorm.DB) *listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &listener{db: db, ctx: ctx, cancel: cancel, wake: make(chan struct{})}
+}
+
+// wait returns a channel closed by the next notification and how long to
+// wait for it at most.
+func (l *listener) wait() (<-chan struct{}, time.Duration) {
+	l.once.Do(func() {
+		l.listening = true
+		l.done.Add(1)
+		go l.listen()
+	})
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.listening {
+		return l.wake, pushInterval
+	}
+	return l.wake, popTimeout
+}
+
+func (l *listener) broadcast() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// release stops the listening goroutine, if it was ever started, and waits
+// for it to close its connection.
+func (l *listener) release() {
+	l.once.Do(func() {})
+	l.cancel()
+	l.done.Wait()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.listening = false
+}
+
+func (l *listener) listen() {
+	defer l.done.Done()
+
+	for {
+		err := l.run()
+		// notifications sent while the connection was down are lost.
+		l.broadcast()
+		if err == errNoListen || l.ctx.Err() != nil {
+			l.lock.Lock()
+			l.listening = false
+			l.lock.Unlock()
+			return
+		}
+
+		select {
+		case <-l.ctx.Done():
+		case <-time.After(popTimeout):
+		}
+	}
+}
+
+func (l *listener) run() error {
+	db, err := l.db.DB()
+	if err != nil {
+		return errNoListen
+	}
+	conn, err := db.Conn(l.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var listenErr error
+	conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			listenErr = errNoListen
+			return nil
+		}
+
+		if _, listenErr = c.Conn().Exec(l.ctx, "LISTEN "+channel); listenErr != nil {
+			return driver.ErrBadConn
+		}
+		for {
+			if _, listenErr = c.Conn().WaitForNotification(l.ctx); listenErr != nil {
+				// the connection is still listening, so it must not go
+				// back to the pool.
+				return driver.ErrBadConn
+			}
+			l.broadcast()
+		}
+	})
+
+	return listenErr
+}
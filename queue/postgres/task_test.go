@@ -0,0 +1,106 @@
+package postgres_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/postgres"
+	"github.com/ZutrixPog/dispatcher/queue/queuetest"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestQueue_Conformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		return postgres.NewTaskQueue(db, limit, opts...)
+	})
+}
+
+func TestQueue_SkipLocked(t *testing.T) {
+	queue := fmt.Sprintf("locked-%d", time.Now().UnixNano())
+	q := postgres.NewTaskQueue(db, 10)
+
+	for _, data := range []string{"a", "b"} {
+		_, err := q.Push(context.Background(), queue, tq.Message{Data: []byte(data)})
+		require.NoError(t, err)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// hold the lock on the head of the queue like a pop in progress.
+		var id int64
+		err := tx.Raw(`SELECT id FROM queue_tasks WHERE queue = ? ORDER BY id LIMIT 1 FOR UPDATE`, queue).Scan(&id).Error
+		require.NoError(t, err)
+
+		task, err := q.Pop(context.Background(), queue)
+		require.NoError(t, err, "pops skip locked tasks instead of waiting")
+		require.Equal(t, []byte("b"), task.Data)
+
+		_, err = q.Pop(context.Background(), queue)
+		require.ErrorIs(t, err, tq.ErrEmptyQueue)
+		return nil
+	})
+	require.NoError(t, err)
+
+	task, err := q.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), task.Data)
+}
+
+func TestQueue_Notify(t *testing.T) {
+	queue := fmt.Sprintf("notify-%d", time.Now().UnixNano())
+	q := postgres.NewTaskQueue(db, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	popped := make(chan tq.Message, 1)
+	go func() {
+		if task, err := q.BlockingPop(ctx, queue); err == nil {
+			popped <- task
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	pushed := time.Now()
+	_, err := q.Push(context.Background(), queue, tq.Message{Data: []byte("a")})
+	require.NoError(t, err)
+
+	select {
+	case task := <-popped:
+		require.Equal(t, []byte("a"), task.Data)
+		require.Less(t, time.Since(pushed), 500*time.Millisecond, "the push wakes the blocked pop")
+	case <-ctx.Done():
+		t.Fatal("blocking pop was not woken up")
+	}
+}
+
+func TestQueue_Release(t *testing.T) {
+	queue := fmt.Sprintf("release-%d", time.Now().UnixNano())
+	q := postgres.NewTaskQueue(db, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := q.BlockingPop(ctx, queue)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	inUse := sqlDB.Stats().InUse
+
+	done := make(chan error, 1)
+	go func() { done <- q.(tq.Releaser).Release() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("release did not stop the listener")
+	}
+	require.Equal(t, inUse-1, sqlDB.Stats().InUse, "the listening connection is closed")
+
+	_, err = q.Push(context.Background(), queue, tq.Message{Data: []byte("a")})
+	require.NoError(t, err)
+	task, err := q.BlockingPop(context.Background(), queue)
+	require.NoError(t, err, "a released queue polls for tasks")
+	require.Equal(t, []byte("a"), task.Data)
+}
@@ -1,6 +1,10 @@
 package queue
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 var (
 	ErrEmptyID           = errors.New("empty ID")
@@ -12,23 +16,220 @@ var (
 	ErrRetrieveEntity    = errors.New("failed to retrieve entity")
 	ErrCreateEntity      = errors.New("failed to create entity")
 	ErrRemoveEntity      = errors.New("failed to remove entity")
+	ErrQueuePaused       = errors.New("queue is paused")
+	ErrSettled           = errors.New("delivery already settled")
+	ErrInvalidQueueName  = errors.New("invalid queue name")
 )
 
+// Message is a serialized task along with the metadata backends need to
+// order it without decoding the payload.
+type Message struct {
+	// ID identifies the message within its queue, for RemoveID and Acker
+	// implementations. Like Queue it is set by backends.
+	ID string
+	// Queue is the queue the message is stored in. Backends set it on every
+	// message they return and ignore it on Push.
+	Queue    string
+	Type     string
+	Headers  map[string]string
+	Priority int
+	// Enqueued is when the message was pushed or moved to its queue. Like
+	// Queue it is set by backends.
+	Enqueued time.Time
+	Data     []byte
+}
+
+// Pusher pushes tasks to queues. Every TaskQueue is a Pusher.
+type Pusher interface {
+	Push(ctx context.Context, queue string, task Message) (int, error)
+}
+
+// Acker is implemented by backends that keep popped tasks until they are
+// acknowledged, so that a task whose consumer died before acknowledging it
+// is delivered again.
+type Acker interface {
+	Ack(ctx context.Context, task Message) error
+}
+
+// Releaser is implemented by backends holding resources, like background
+// work, that the dispatcher releases along with its own on Release.
+type Releaser interface {
+	Release() error
+}
+
+// Stats describes a queue at a point in time. Enqueued and Dequeued count
+// the tasks pushed or moved to and popped from the queue since it was first
+// used, so rates come from comparing two samples.
+type Stats struct {
+	Queue    string
+	Length   int
+	Paused   bool
+	Enqueued int64
+	Dequeued int64
+	// Oldest is when the oldest task of the queue was enqueued, zero if the
+	// queue is empty.
+	Oldest time.Time
+	// At is when the stats were taken.
+	At time.Time
+}
+
+// Age returns how long the oldest task has been waiting.
+func (s Stats) Age() time.Duration {
+	if s.Oldest.IsZero() {
+		return 0
+	}
+
+	return s.At.Sub(s.Oldest)
+}
+
+// Rates returns the tasks enqueued and dequeued per second since an earlier
+// sample of the same queue.
+func (s Stats) Rates(earlier Stats) (enqueued, dequeued float64) {
+	elapsed := s.At.Sub(earlier.At).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+
+	return float64(s.Enqueued-earlier.Enqueued) / elapsed, float64(s.Dequeued-earlier.Dequeued) / elapsed
+}
+
+// Filter selects messages by type and headers. Empty fields match every
+// message, so the zero Filter matches everything.
+type Filter struct {
+	Type    string
+	Headers map[string]string
+}
+
+func (f Filter) Match(msg Message) bool {
+	if f.Type != "" && f.Type != msg.Type {
+		return false
+	}
+	for key, value := range f.Headers {
+		if msg.Headers[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Page selects the tasks List returns: the tasks matching the filter and
+// enqueued within the bounds, in pop order, skipping the first Offset of
+// them and keeping at most Limit. The zero Page selects every task.
+type Page struct {
+	Filter
+	Offset int
+	// Limit is the most tasks returned, unlimited when not positive.
+	Limit int
+	// Before and After bound when the tasks were enqueued, exclusively.
+	// Zero times leave the bounds open.
+	Before time.Time
+	After  time.Time
+}
+
+func (p Page) Match(msg Message) bool {
+	if !p.Before.IsZero() && !msg.Enqueued.Before(p.Before) {
+		return false
+	}
+	if !p.After.IsZero() && !msg.Enqueued.After(p.After) {
+		return false
+	}
+
+	return p.Filter.Match(msg)
+}
+
+// Full reports whether n tasks fill the page.
+func (p Page) Full(n int) bool {
+	return p.Limit > 0 && n >= p.Limit
+}
+
+// Unfiltered reports whether the page selects tasks by position only.
+func (p Page) Unfiltered() bool {
+	return p.Type == "" && len(p.Headers) == 0 && p.Before.IsZero() && p.After.IsZero()
+}
+
+// TaskQueue stores tasks in named queues. Every queue is kept in pop order:
+// tasks with a higher priority come first and tasks of the same priority
+// follow the Order the queue is configured with, FIFO unless stated
+// otherwise. Indexes always refer to positions in that order, so index 0 is
+// the task the next Pop returns.
+//
+// A paused queue still accepts, lists and removes tasks but none are popped
+// from it until it is resumed. Pause state is kept by the backend, so every
+// process sharing the backend sees it.
+//
+// Every method gives up once ctx is done, with the error of ctx wherever it
+// waits, like a blocked push or pop, and with the error of the failed
+// operation otherwise. A cancelled BlockingPop pops nothing and leaves
+// nothing running behind.
 type TaskQueue interface {
-	// Push pushes a task to the queue.
-	Push(queue string, task []byte) (int, error)
+	// Push pushes a task to the queue and returns its index. When the queue
+	// is full the overflow policy of the queue applies; a blocked push gives
+	// up with the error of ctx.
+	Push(ctx context.Context, queue string, task Message) (int, error)
+
+	// Requeue pushes a popped task back to its queue like Push but
+	// whatever the limit of the queue, so a task handed back by its
+	// consumer is never rejected, waited on or traded for another one.
+	Requeue(ctx context.Context, queue string, task Message) error
 
 	// Removes a task from the queue given the index
-	Remove(queue string, index int) error
+	Remove(ctx context.Context, queue string, index int) error
 
-	// Pop pops a task from the queue.
-	Pop(queue string) ([]byte, error)
+	// RemoveID removes the task with the given ID, as set on the messages
+	// the queue returns, so that the task removed is the one that was
+	// read whatever was popped in between. It returns ErrEntityNotFound
+	// when no task of the queue has the ID.
+	RemoveID(ctx context.Context, queue string, id string) error
 
-	BlockingPop(queue string) <-chan []byte
+	// Pop pops a task from the queue. It returns ErrQueuePaused while the
+	// queue is paused.
+	Pop(ctx context.Context, queue string) (Message, error)
+
+	// PopFilter atomically pops the first task in pop order matching the
+	// filter. It returns ErrEmptyQueue when no task matches and
+	// ErrQueuePaused while the queue is paused.
+	PopFilter(ctx context.Context, queue string, filter Filter) (Message, error)
+
+	// PopN pops up to n tasks in pop order in one step of the backend. It
+	// returns ErrEmptyQueue when the queue is empty and ErrQueuePaused while
+	// the queue is paused, and nothing when n is not positive.
+	PopN(ctx context.Context, queue string, n int) ([]Message, error)
+
+	// BlockingPop waits until one of the queues has a task and pops it, or
+	// until ctx is done. The queues are checked in the given order and
+	// paused queues are skipped until they are resumed.
+	BlockingPop(ctx context.Context, queues ...string) (Message, error)
 
 	// Get gets a task with a specific ID from the queue
-	Get(queue string, id int) ([]byte, error)
+	Get(ctx context.Context, queue string, id int) (Message, error)
+
+	// List lists the tasks of the queue the page selects. It returns
+	// ErrEmptyQueue when the page selects none.
+	List(ctx context.Context, queue string, page Page) ([]Message, error)
+
+	// Pause stops tasks from being popped from the queue.
+	Pause(ctx context.Context, queue string) error
+
+	// Resume lets tasks be popped from a paused queue again.
+	Resume(ctx context.Context, queue string) error
+
+	// Paused reports whether the queue is paused.
+	Paused(ctx context.Context, queue string) (bool, error)
+
+	// Delete atomically removes every task of the queue matching the filter
+	// and returns them in pop order.
+	Delete(ctx context.Context, queue string, filter Filter) ([]Message, error)
+
+	// Move atomically moves every task matching the filter from one queue to
+	// another and returns them in the order they were popped from the
+	// source. Nothing is moved when the destination can not take them all,
+	// whatever its overflow policy.
+	Move(ctx context.Context, from, to string, filter Filter) ([]Message, error)
+
+	// ListQueues lists every queue that has been pushed to, sorted by name.
+	ListQueues(ctx context.Context) ([]string, error)
 
-	// List lists all tasks in the queue
-	List(queue string) ([][]byte, error)
+	// QueueStats returns the stats of the queue.
+	QueueStats(ctx context.Context, queue string) (Stats, error)
 }
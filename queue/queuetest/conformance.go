@@ -0,0 +1,1317 @@
+// Package queuetest checks that a queue.TaskQueue implementation follows the
+// contract the dispatcher relies on.
+package queuetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/stretchr/testify/require"
+)
+
+const waitTimeout = 5 * time.Second
+
+// Factory creates the backend under test with the given default limit and
+// options. Backends returned by different calls may share storage; every
+// test uses queue names of its own.
+type Factory func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue
+
+// Capability is an optional part of the contract.
+type Capability int
+
+const (
+	// LIFO is support for queues with the queue.LIFO order.
+	LIFO Capability = iota
+)
+
+type suite struct {
+	factory     Factory
+	unsupported []Capability
+}
+
+func (s suite) supports(capability Capability) bool {
+	for _, c := range s.unsupported {
+		if c == capability {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RunConformance runs the whole TaskQueue contract against the backends
+// created by factory, leaving out the parts that need the unsupported
+// capabilities.
+func RunConformance(t *testing.T, factory Factory, unsupported ...Capability) {
+	s := suite{factory: factory, unsupported: unsupported}
+	tests := []struct {
+		name string
+		test func(t *testing.T, s suite)
+	}{
+		{"FIFO", testFIFO},
+		{"LIFO", testLIFO},
+		{"Priority", testPriority},
+		{"Empty", testEmpty},
+		{"Limit", testLimit},
+		{"GetList", testGetList},
+		{"ListPage", testListPage},
+		{"Remove", testRemove},
+		{"RemoveDuplicates", testRemoveDuplicates},
+		{"RemoveID", testRemoveID},
+		{"Isolation", testIsolation},
+		{"Payload", testPayload},
+		{"PopN", testPopN},
+		{"BlockingPop", testBlockingPop},
+		{"BlockingPopQueues", testBlockingPopQueues},
+		{"BlockingPopWakeup", testBlockingPopWakeup},
+		{"BlockingPopCancel", testBlockingPopCancel},
+		{"Consume", testConsume},
+		{"ConsumeNack", testConsumeNack},
+		{"ConsumeNackFull", testConsumeNackFull},
+		{"ConsumeCancel", testConsumeCancel},
+		{"ConcurrentPushPop", testConcurrentPushPop},
+		{"ConcurrentLimit", testConcurrentLimit},
+		{"Pause", testPause},
+		{"BlockingPopPaused", testBlockingPopPaused},
+		{"Metadata", testMetadata},
+		{"PopFilter", testPopFilter},
+		{"Delete", testDelete},
+		{"Move", testMove},
+		{"MoveLimit", testMoveLimit},
+		{"QueueLimits", testQueueLimits},
+		{"BgQueueLimit", testBgQueueLimit},
+		{"OverflowBlock", testOverflowBlock},
+		{"OverflowDropOldest", testOverflowDropOldest},
+		{"Requeue", testRequeue},
+		{"QueueStats", testQueueStats},
+		{"ListQueues", testListQueues},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, s)
+		})
+	}
+}
+
+func testFIFO(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := messages("a", "b", "c")
+	for i, task := range tasks {
+		index, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+		require.Equal(t, i, index, "push returns the position in pop order")
+	}
+
+	requirePops(t, q, queue, tasks...)
+}
+
+func testLIFO(t *testing.T, s suite) {
+	if !s.supports(LIFO) {
+		t.Skip("LIFO is not supported")
+	}
+
+	queue := queueName(t)
+	q := s.factory(t, 10, tq.WithOrder(queue, tq.LIFO))
+
+	tasks := messages("a", "b", "c")
+	for _, task := range tasks {
+		index, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+		require.Equal(t, 0, index, "push returns the position in pop order")
+	}
+
+	requirePops(t, q, queue, tasks[2], tasks[1], tasks[0])
+}
+
+func testPriority(t *testing.T, s suite) {
+	fifo, lifo := queueName(t)+"-fifo", queueName(t)+"-lifo"
+	q := s.factory(t, 10, tq.WithOrder(lifo, tq.LIFO))
+
+	low1 := tq.Message{Priority: -1, Data: []byte("low1")}
+	low2 := tq.Message{Priority: -1, Data: []byte("low2")}
+	normal := tq.Message{Data: []byte("normal")}
+	high1 := tq.Message{Priority: 3, Data: []byte("high1")}
+	high2 := tq.Message{Priority: 3, Data: []byte("high2")}
+	pushes := []tq.Message{low1, normal, high1, low2, high2}
+
+	cases := []struct {
+		desc    string
+		queue   string
+		indexes []int
+		popped  []tq.Message
+	}{
+		{
+			desc:    "higher priorities first, FIFO within a priority",
+			queue:   fifo,
+			indexes: []int{0, 0, 0, 3, 1},
+			popped:  []tq.Message{high1, high2, normal, low1, low2},
+		},
+		{
+			desc:    "higher priorities first, LIFO within a priority",
+			queue:   lifo,
+			indexes: []int{0, 0, 0, 2, 0},
+			popped:  []tq.Message{high2, high1, normal, low2, low1},
+		},
+	}
+
+	for _, c := range cases {
+		if c.queue == lifo && !s.supports(LIFO) {
+			continue
+		}
+
+		for i, task := range pushes {
+			index, err := q.Push(context.Background(), c.queue, task)
+			require.NoError(t, err, c.desc)
+			require.Equal(t, c.indexes[i], index, c.desc)
+		}
+
+		list, err := q.List(context.Background(), c.queue, tq.Page{})
+		require.NoError(t, err, c.desc)
+		require.Equal(t, inQueue(c.queue, c.popped...), received(t, list...), c.desc)
+
+		requirePops(t, q, c.queue, c.popped...)
+	}
+}
+
+func testEmpty(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	_, err := q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "pop from a queue that was never used")
+
+	_, err = q.List(context.Background(), queue, tq.Page{})
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "list a queue that was never used")
+
+	_, err = q.Get(context.Background(), queue, 0)
+	require.ErrorIs(t, err, tq.ErrEntityNotFound, "get from a queue that was never used")
+
+	require.ErrorIs(t, q.Remove(context.Background(), queue, 0), tq.ErrEntityNotFound, "remove from a queue that was never used")
+
+	_, err = q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+	_, err = q.Pop(context.Background(), queue)
+	require.NoError(t, err)
+
+	_, err = q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "pop from a drained queue")
+
+	_, err = q.List(context.Background(), queue, tq.Page{})
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "list a drained queue")
+}
+
+func testLimit(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 3)
+
+	for _, task := range messages("a", "b", "c") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	_, err := q.Push(context.Background(), queue, message("d"))
+	require.ErrorIs(t, err, tq.ErrFullQueue, "push to a full queue")
+
+	_, err = q.Push(context.Background(), queue, tq.Message{Priority: 10, Data: []byte("d")})
+	require.ErrorIs(t, err, tq.ErrFullQueue, "the limit covers every priority")
+
+	_, err = q.Pop(context.Background(), queue)
+	require.NoError(t, err)
+
+	_, err = q.Push(context.Background(), queue, message("d"))
+	require.NoError(t, err, "push after making room")
+
+	requirePops(t, q, queue, messages("b", "c", "d")...)
+}
+
+func testGetList(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := []tq.Message{message("a"), {Priority: 1, Data: []byte("b")}, message("c")}
+	for _, task := range tasks {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, tasks[1], tasks[0], tasks[2]), received(t, list...))
+
+	for i := range list {
+		task, err := q.Get(context.Background(), queue, i)
+		require.NoError(t, err)
+		require.Equal(t, list[i], task, "get agrees with list")
+	}
+
+	_, err = q.Get(context.Background(), queue, len(list))
+	require.ErrorIs(t, err, tq.ErrEntityNotFound, "get past the end")
+
+	_, err = q.Get(context.Background(), queue, -1)
+	require.ErrorIs(t, err, tq.ErrEntityNotFound, "get a negative index")
+
+	again, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, list, again, "list and get do not consume tasks")
+}
+
+func testListPage(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := messages("a", "b", "c", "d", "e")
+	tasks[1].Priority, tasks[3].Priority = 1, 1
+	tasks[2].Type, tasks[3].Type = "report", "report"
+	tasks[4].Headers = map[string]string{"tenant": "acme"}
+	for _, task := range tasks[:3] {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mark := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	for _, task := range tasks[3:] {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	pages := []struct {
+		desc     string
+		page     tq.Page
+		expected []tq.Message
+	}{
+		{"every task", tq.Page{}, []tq.Message{tasks[1], tasks[3], tasks[0], tasks[2], tasks[4]}},
+		{"a window across priorities", tq.Page{Offset: 1, Limit: 3}, []tq.Message{tasks[3], tasks[0], tasks[2]}},
+		{"the end of the queue", tq.Page{Offset: 4, Limit: 3}, []tq.Message{tasks[4]}},
+		{"a type", tq.Page{Filter: tq.Filter{Type: "report"}}, []tq.Message{tasks[3], tasks[2]}},
+		{"a window of a type", tq.Page{Filter: tq.Filter{Type: "report"}, Offset: 1, Limit: 1}, []tq.Message{tasks[2]}},
+		{"headers", tq.Page{Filter: tq.Filter{Headers: map[string]string{"tenant": "acme"}}}, []tq.Message{tasks[4]}},
+		{"enqueued before", tq.Page{Before: mark}, []tq.Message{tasks[1], tasks[0], tasks[2]}},
+		{"enqueued after", tq.Page{After: mark, Limit: 1}, []tq.Message{tasks[3]}},
+	}
+	for _, p := range pages {
+		list, err := q.List(context.Background(), queue, p.page)
+		require.NoError(t, err, p.desc)
+		require.Equal(t, inQueue(queue, p.expected...), received(t, list...), p.desc)
+	}
+
+	_, err := q.List(context.Background(), queue, tq.Page{Offset: len(tasks)})
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "a page past the end selects nothing")
+	_, err = q.List(context.Background(), queue, tq.Page{Filter: tq.Filter{Type: "missing"}})
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "a filter matching nothing selects nothing")
+}
+
+func testRemove(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	for _, task := range messages("a", "b", "c", "d") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, q.Remove(context.Background(), queue, 1), "remove from the middle")
+	require.NoError(t, q.Remove(context.Background(), queue, 2), "remove the last task")
+	require.ErrorIs(t, q.Remove(context.Background(), queue, 2), tq.ErrEntityNotFound, "remove past the end")
+	require.ErrorIs(t, q.Remove(context.Background(), queue, -1), tq.ErrEntityNotFound, "remove a negative index")
+
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, messages("a", "c")...), received(t, list...))
+
+	require.NoError(t, q.Remove(context.Background(), queue, 0), "remove the head")
+	requirePops(t, q, queue, message("c"))
+}
+
+func testRemoveDuplicates(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	for _, task := range messages("DELETED", "a", "DELETED", "a") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, q.Remove(context.Background(), queue, 1), "remove one of two equal tasks")
+	require.NoError(t, q.Remove(context.Background(), queue, 0), "remove a task whose payload is a tombstone")
+
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, messages("DELETED", "a")...), received(t, list...))
+}
+
+func testRemoveID(t *testing.T, s suite) {
+	queue, other := queueName(t), queueName(t)+"-other"
+	q := s.factory(t, 10)
+
+	// the task of the other queue is pushed first: backends numbering the
+	// tasks of each queue by time, like streams, could otherwise give it
+	// the ID of the second task.
+	_, err := q.Push(context.Background(), other, message("a"))
+	require.NoError(t, err)
+	for _, task := range messages("a", "a", "b") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	second, err := q.Get(context.Background(), queue, 1)
+	require.NoError(t, err)
+	requirePop(t, q, queue, message("a"))
+
+	require.ErrorIs(t, q.RemoveID(context.Background(), other, second.ID), tq.ErrEntityNotFound, "remove an ID of another queue")
+	require.NoError(t, q.RemoveID(context.Background(), queue, second.ID), "remove a task that moved since it was read")
+	require.ErrorIs(t, q.RemoveID(context.Background(), queue, second.ID), tq.ErrEntityNotFound, "remove a removed task")
+	require.ErrorIs(t, q.RemoveID(context.Background(), queue, "missing"), tq.ErrEntityNotFound, "remove a missing ID")
+
+	requirePops(t, q, queue, message("b"))
+	requirePops(t, q, other, message("a"))
+}
+
+func testIsolation(t *testing.T, s suite) {
+	first, second := queueName(t)+"-1", queueName(t)+"-2"
+	q := s.factory(t, 1)
+
+	_, err := q.Push(context.Background(), first, message("a"))
+	require.NoError(t, err)
+
+	_, err = q.Push(context.Background(), second, message("b"))
+	require.NoError(t, err, "limits are per queue")
+
+	requirePops(t, q, second, message("b"))
+	requirePops(t, q, first, message("a"))
+}
+
+func testPayload(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := []tq.Message{
+		{Data: []byte{}},
+		{Data: []byte{0, 1, 2, 0, 255}},
+		{Data: []byte("DELETED")},
+		{Data: []byte("line\nbreak\r\n")},
+		{Data: []byte(strings.Repeat("x", 1<<16))},
+	}
+	for _, task := range tasks {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	requirePops(t, q, queue, tasks...)
+}
+
+func testPopN(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := messages("a", "b", "c", "d")
+	tasks[1].Priority, tasks[3].Priority = 2, 1
+	for _, task := range tasks {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	popped, err := q.PopN(context.Background(), queue, 0)
+	require.NoError(t, err)
+	require.Empty(t, popped, "nothing is popped when n is not positive")
+
+	popped, err = q.PopN(context.Background(), queue, 3)
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, tasks[1], tasks[3], tasks[0]), received(t, popped...), "a batch follows pop order across priorities")
+
+	require.NoError(t, q.Pause(context.Background(), queue))
+	_, err = q.PopN(context.Background(), queue, 3)
+	require.ErrorIs(t, err, tq.ErrQueuePaused)
+	require.NoError(t, q.Resume(context.Background(), queue))
+
+	popped, err = q.PopN(context.Background(), queue, 3)
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, tasks[2]), received(t, popped...), "a batch stops at the end of the queue")
+
+	_, err = q.PopN(context.Background(), queue, 3)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue)
+
+	stats, err := q.QueueStats(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(tasks)), stats.Dequeued)
+}
+
+func testBlockingPop(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	for _, task := range messages("a", "b") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	for _, expected := range inQueue(queue, messages("a", "b")...) {
+		select {
+		case task := <-popAsync(q, queue):
+			require.Equal(t, expected, received(t, task)[0], "blocking pop follows the queue order")
+		case <-time.After(waitTimeout):
+			t.Fatal("blocking pop did not return a queued task")
+		}
+	}
+
+	_, err := q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "blocking pop consumes tasks")
+}
+
+func testBlockingPopQueues(t *testing.T, s suite) {
+	first, second, third := queueName(t)+"-1", queueName(t)+"-2", queueName(t)+"-3"
+	q := s.factory(t, 10)
+
+	_, err := q.Push(context.Background(), second, message("b"))
+	require.NoError(t, err)
+	_, err = q.Push(context.Background(), first, message("a"))
+	require.NoError(t, err)
+
+	expected := append(inQueue(first, message("a")), inQueue(second, message("b"))...)
+	for _, expected := range expected {
+		select {
+		case task := <-popAsync(q, first, second, third):
+			require.Equal(t, expected, received(t, task)[0], "queues are checked in the given order")
+		case <-time.After(waitTimeout):
+			t.Fatal("blocking pop did not return a queued task")
+		}
+	}
+
+	popped := popAsync(q, first, second, third)
+	time.Sleep(100 * time.Millisecond)
+	_, err = q.Push(context.Background(), third, message("c"))
+	require.NoError(t, err)
+
+	select {
+	case task := <-popped:
+		require.Equal(t, inQueue(third, message("c"))[0], received(t, task)[0], "any of the queues wakes the pop")
+	case <-time.After(waitTimeout):
+		t.Fatal("blocking pop did not wake up")
+	}
+}
+
+func testBlockingPopWakeup(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	waiters := 3
+	results := make(chan tq.Message, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			results <- <-popAsync(q, queue)
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case task := <-results:
+		t.Fatalf("blocking pop returned %q from an empty queue", task.Data)
+	default:
+	}
+
+	tasks := messages("a", "b", "c")
+	for _, task := range tasks {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	received := make(map[string]bool)
+	for i := 0; i < waiters; i++ {
+		select {
+		case task := <-results:
+			require.False(t, received[string(task.Data)], "task delivered twice")
+			received[string(task.Data)] = true
+		case <-time.After(waitTimeout):
+			t.Fatalf("only %d of %d waiters woke up", i, waiters)
+		}
+	}
+	require.Len(t, received, len(tasks))
+}
+
+func testBlockingPopCancel(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := q.BlockingPop(ctx, queue)
+	require.ErrorIs(t, err, context.DeadlineExceeded, "blocking pop gives up when ctx is done")
+
+	_, err = q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = q.BlockingPop(ctx, queue)
+	require.ErrorIs(t, err, context.Canceled)
+
+	requirePops(t, q, queue, message("a"))
+}
+
+func testConsume(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	for _, task := range messages("a", "b", "c") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := tq.Consume(ctx, q, []string{queue}, 2)
+
+	first, second := requireDelivery(t, stream), requireDelivery(t, stream)
+	require.Equal(t, []byte("a"), first.Data)
+	require.Equal(t, []byte("b"), second.Data)
+	select {
+	case delivery := <-stream.Deliveries():
+		t.Fatalf("%q delivered beyond the prefetch", delivery.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, first.Ack(context.Background()))
+	require.ErrorIs(t, first.Ack(context.Background()), tq.ErrSettled)
+	third := requireDelivery(t, stream)
+	require.Equal(t, []byte("c"), third.Data, "an ack frees a prefetch slot")
+	require.NoError(t, second.Ack(context.Background()))
+	require.NoError(t, third.Ack(context.Background()))
+
+	cancel()
+	requireClosed(t, stream)
+	require.ErrorIs(t, stream.Err(), context.Canceled)
+	requirePops(t, q, queue)
+}
+
+func testConsumeNack(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	_, err := q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := tq.Consume(ctx, q, []string{queue}, 1)
+
+	delivery := requireDelivery(t, stream)
+	require.NoError(t, delivery.Nack(context.Background()))
+	require.ErrorIs(t, delivery.Ack(context.Background()), tq.ErrSettled)
+
+	delivery = requireDelivery(t, stream)
+	require.Equal(t, []byte("a"), delivery.Data, "a nacked task is delivered again")
+	require.NoError(t, delivery.Ack(context.Background()))
+
+	cancel()
+	requireClosed(t, stream)
+	requirePops(t, q, queue)
+}
+
+func testConsumeNackFull(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 1)
+
+	_, err := q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := tq.Consume(ctx, q, []string{queue}, 1)
+
+	delivery := requireDelivery(t, stream)
+	_, err = q.Push(context.Background(), queue, message("b"))
+	require.NoError(t, err)
+	require.NoError(t, delivery.Nack(context.Background()), "nack to a full queue")
+
+	cancel()
+	requireClosed(t, stream)
+	requirePops(t, q, queue, messages("b", "a")...)
+}
+
+func testConsumeCancel(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := messages("a", "b")
+	for _, task := range tasks {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := tq.Consume(ctx, q, []string{queue}, len(tasks))
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// whatever the stream did not push back by now is handed back here.
+	for delivery := range stream.Deliveries() {
+		require.NoError(t, delivery.Nack(context.Background()))
+	}
+	require.ErrorIs(t, stream.Err(), context.Canceled)
+	requirePops(t, q, queue, tasks...)
+}
+
+func testConcurrentPushPop(t *testing.T, s suite) {
+	queue := queueName(t)
+	producers, tasks := 4, 25
+	q := s.factory(t, int64(producers*tasks))
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				if _, err := q.Push(context.Background(), queue, message(fmt.Sprintf("%d-%d", p, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(p)
+	}
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	for c := 0; c < producers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				select {
+				case task := <-popAsync(q, queue):
+					mu.Lock()
+					received[string(task.Data)]++
+					mu.Unlock()
+				case <-time.After(waitTimeout):
+					t.Error("blocking pop starved while producers were pushing")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, received, producers*tasks)
+	for data, count := range received {
+		require.Equal(t, 1, count, "task %s delivered more than once", data)
+	}
+
+	_, err := q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue)
+}
+
+func testConcurrentLimit(t *testing.T, s suite) {
+	queue := queueName(t)
+	producers, tasks, limit := 8, 10, 25
+	q := s.factory(t, int64(limit))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pushed := 0
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				_, err := q.Push(context.Background(), queue, message(fmt.Sprintf("%d-%d", p, i)))
+				if err == tq.ErrFullQueue {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				pushed++
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	require.Equal(t, limit, pushed, "concurrent producers fill the queue exactly to its limit")
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Len(t, list, limit)
+}
+
+func testPause(t *testing.T, s suite) {
+	queue, other := queueName(t), queueName(t)+"-other"
+	q := s.factory(t, 10)
+
+	paused, err := q.Paused(context.Background(), queue)
+	require.NoError(t, err)
+	require.False(t, paused, "queues start resumed")
+
+	_, err = q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+	require.NoError(t, q.Pause(context.Background(), queue))
+
+	paused, err = q.Paused(context.Background(), queue)
+	require.NoError(t, err)
+	require.True(t, paused)
+
+	_, err = q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrQueuePaused, "pop from a paused queue")
+
+	_, err = q.Push(context.Background(), queue, message("b"))
+	require.NoError(t, err, "push to a paused queue")
+
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err, "list a paused queue")
+	require.Equal(t, inQueue(queue, messages("a", "b")...), received(t, list...))
+
+	_, err = q.Push(context.Background(), other, message("c"))
+	require.NoError(t, err)
+	requirePops(t, q, other, message("c"))
+
+	require.NoError(t, q.Resume(context.Background(), queue))
+	paused, err = q.Paused(context.Background(), queue)
+	require.NoError(t, err)
+	require.False(t, paused)
+
+	requirePops(t, q, queue, messages("a", "b")...)
+}
+
+func testBlockingPopPaused(t *testing.T, s suite) {
+	queue, other := queueName(t), queueName(t)+"-other"
+	q := s.factory(t, 10)
+
+	_, err := q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+	require.NoError(t, q.Pause(context.Background(), queue))
+
+	popped := popAsync(q, queue, other)
+	_, err = q.Push(context.Background(), other, message("b"))
+	require.NoError(t, err)
+
+	select {
+	case task := <-popped:
+		require.Equal(t, inQueue(other, message("b"))[0], received(t, task)[0], "paused queues are skipped")
+	case <-time.After(waitTimeout):
+		t.Fatal("blocking pop did not return a task from the queue that is not paused")
+	}
+
+	popped = popAsync(q, queue)
+	select {
+	case task := <-popped:
+		t.Fatalf("blocking pop returned %q from a paused queue", task.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, q.Resume(context.Background(), queue))
+	select {
+	case task := <-popped:
+		require.Equal(t, inQueue(queue, message("a"))[0], received(t, task)[0], "resuming wakes the pop")
+	case <-time.After(waitTimeout):
+		t.Fatal("blocking pop did not wake up after the queue was resumed")
+	}
+}
+
+func testMetadata(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	tasks := []tq.Message{
+		{Type: "email", Headers: map[string]string{"tenant": "acme", "empty": ""}, Data: []byte("a")},
+		{Type: "sms", Data: []byte("b")},
+		{Headers: map[string]string{"tenant": "acme"}, Data: []byte("c")},
+	}
+	for _, task := range tasks {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, tasks...), received(t, list...), "list keeps types and headers")
+
+	task, err := q.Get(context.Background(), queue, 0)
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, tasks[0])[0], received(t, task)[0], "get keeps types and headers")
+
+	requirePops(t, q, queue, tasks...)
+}
+
+func testPopFilter(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	email := tq.Message{Type: "email", Headers: map[string]string{"tenant": "acme"}, Data: []byte("a")}
+	sms := tq.Message{Type: "sms", Data: []byte("b")}
+	urgent := tq.Message{Type: "sms", Priority: 2, Data: []byte("c")}
+	other := tq.Message{Type: "email", Headers: map[string]string{"tenant": "other"}, Data: []byte("d")}
+	for _, task := range []tq.Message{email, sms, urgent, other} {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	task, err := q.PopFilter(context.Background(), queue, tq.Filter{Type: "email"})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, email), received(t, task), "the first match in pop order")
+
+	task, err = q.PopFilter(context.Background(), queue, tq.Filter{Type: "sms"})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, urgent), received(t, task), "higher priorities match first")
+
+	task, err = q.PopFilter(context.Background(), queue, tq.Filter{Headers: map[string]string{"tenant": "other"}})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, other), received(t, task))
+
+	_, err = q.PopFilter(context.Background(), queue, tq.Filter{Type: "email"})
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "nothing matches")
+
+	require.NoError(t, q.Pause(context.Background(), queue))
+	_, err = q.PopFilter(context.Background(), queue, tq.Filter{})
+	require.ErrorIs(t, err, tq.ErrQueuePaused)
+	require.NoError(t, q.Resume(context.Background(), queue))
+
+	task, err = q.PopFilter(context.Background(), queue, tq.Filter{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, sms), received(t, task), "the empty filter pops the head")
+
+	stats, err := q.QueueStats(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), stats.Dequeued)
+}
+
+func testDelete(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 10)
+
+	emailAcme := tq.Message{Type: "email", Headers: map[string]string{"tenant": "acme"}, Data: []byte("a")}
+	sms := tq.Message{Type: "sms", Headers: map[string]string{"tenant": "acme"}, Data: []byte("b")}
+	urgent := tq.Message{Type: "email", Priority: 2, Data: []byte("c")}
+	emailOther := tq.Message{Type: "email", Headers: map[string]string{"tenant": "other"}, Data: []byte("d")}
+	for _, task := range []tq.Message{emailAcme, sms, urgent, emailOther} {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	removed, err := q.Delete(context.Background(), queue, tq.Filter{Type: "email", Headers: map[string]string{"tenant": "acme"}})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, emailAcme), received(t, removed...), "every filter field has to match")
+
+	removed, err = q.Delete(context.Background(), queue, tq.Filter{Type: "email"})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, urgent, emailOther), received(t, removed...), "removed tasks are returned in pop order")
+
+	removed, err = q.Delete(context.Background(), queue, tq.Filter{Type: "push"})
+	require.NoError(t, err)
+	require.Empty(t, removed, "nothing matches")
+
+	list, err := q.List(context.Background(), queue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, sms), received(t, list...))
+
+	for _, task := range messages("e", "f") {
+		_, err := q.Push(context.Background(), queue, task)
+		require.NoError(t, err)
+	}
+
+	removed, err = q.Delete(context.Background(), queue, tq.Filter{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, sms, message("e"), message("f")), received(t, removed...), "the empty filter purges the queue")
+
+	_, err = q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue)
+
+	removed, err = q.Delete(context.Background(), queueName(t)+"-unused", tq.Filter{})
+	require.NoError(t, err, "purge a queue that was never used")
+	require.Empty(t, removed)
+}
+
+func testMove(t *testing.T, s suite) {
+	from, to := queueName(t)+"-from", queueName(t)+"-to"
+	var opts []tq.Option
+	if s.supports(LIFO) {
+		opts = append(opts, tq.WithOrder(to, tq.LIFO))
+	}
+	q := s.factory(t, 10, opts...)
+
+	a := tq.Message{Type: "email", Data: []byte("a")}
+	b := tq.Message{Type: "sms", Data: []byte("b")}
+	c := tq.Message{Type: "email", Priority: 1, Data: []byte("c")}
+	d := tq.Message{Type: "email", Data: []byte("d")}
+	for _, task := range []tq.Message{a, b, c, d} {
+		_, err := q.Push(context.Background(), from, task)
+		require.NoError(t, err)
+	}
+	existing := tq.Message{Type: "email", Data: []byte("e")}
+	_, err := q.Push(context.Background(), to, existing)
+	require.NoError(t, err)
+
+	moved, err := q.Move(context.Background(), from, to, tq.Filter{Type: "email"})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(from, c, a, d), received(t, moved...), "moved tasks are returned in pop order")
+
+	list, err := q.List(context.Background(), from, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(from, b), received(t, list...), "moved tasks leave the source")
+
+	expected := inQueue(to, c, existing, a, d)
+	if s.supports(LIFO) {
+		expected = inQueue(to, c, d, a, existing)
+	}
+	list, err = q.List(context.Background(), to, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, expected, received(t, list...), "moved tasks are pushed in the order of the destination")
+
+	moved, err = q.Move(context.Background(), from, to, tq.Filter{Type: "push"})
+	require.NoError(t, err)
+	require.Empty(t, moved, "nothing matches")
+}
+
+func testMoveLimit(t *testing.T, s suite) {
+	from, to := queueName(t)+"-from", queueName(t)+"-to"
+	q := s.factory(t, 3)
+
+	for _, task := range messages("a", "b", "c") {
+		_, err := q.Push(context.Background(), from, task)
+		require.NoError(t, err)
+	}
+	_, err := q.Push(context.Background(), to, message("d"))
+	require.NoError(t, err)
+
+	_, err = q.Move(context.Background(), from, to, tq.Filter{})
+	require.ErrorIs(t, err, tq.ErrFullQueue, "move more tasks than the destination can take")
+
+	list, err := q.List(context.Background(), from, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, inQueue(from, messages("a", "b", "c")...), received(t, list...), "a failed move leaves the source untouched")
+
+	requirePops(t, q, to, message("d"))
+}
+
+func testQueueLimits(t *testing.T, s suite) {
+	limited, unlimited, other := queueName(t)+"-limited", queueName(t)+"-unlimited", queueName(t)+"-other"
+	q := s.factory(t, 2, tq.WithLimit(limited, 3), tq.WithLimit(unlimited, 0))
+
+	cases := []struct {
+		queue string
+		fits  int
+	}{
+		{limited, 3},
+		{unlimited, 5},
+		{other, 2},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < c.fits; i++ {
+			_, err := q.Push(context.Background(), c.queue, message("a"))
+			require.NoError(t, err, "push %d to %s", i, c.queue)
+		}
+		if c.queue == unlimited {
+			continue
+		}
+
+		_, err := q.Push(context.Background(), c.queue, message("a"))
+		require.ErrorIs(t, err, tq.ErrFullQueue, "push past the limit of %s", c.queue)
+	}
+}
+
+func testBgQueueLimit(t *testing.T, s suite) {
+	// the namespace keeps the shared background queue apart from that of
+	// other tests.
+	q := s.factory(t, 1, tq.WithNamespace(queueName(t)))
+	for _, task := range messages("a", "b") {
+		_, err := q.Push(context.Background(), tq.BgQueue, task)
+		require.NoError(t, err, "the background queue is unlimited by default")
+	}
+	requirePops(t, q, tq.BgQueue, messages("a", "b")...)
+
+	limited := s.factory(t, 0, tq.WithNamespace(queueName(t)+"-limited"), tq.WithLimit(tq.BgQueue, 1))
+	_, err := limited.Push(context.Background(), tq.BgQueue, message("a"))
+	require.NoError(t, err)
+	_, err = limited.Push(context.Background(), tq.BgQueue, message("b"))
+	require.ErrorIs(t, err, tq.ErrFullQueue, "the background queue can be given a limit")
+	requirePops(t, limited, tq.BgQueue, message("a"))
+}
+
+func testOverflowBlock(t *testing.T, s suite) {
+	queue := queueName(t)
+	q := s.factory(t, 1, tq.WithOverflow(queue, tq.Block))
+
+	_, err := q.Push(context.Background(), queue, message("a"))
+	require.NoError(t, err)
+
+	pushed := make(chan error, 1)
+	go func() {
+		_, err := q.Push(context.Background(), queue, message("b"))
+		pushed <- err
+	}()
+
+	select {
+	case err := <-pushed:
+		t.Fatalf("push to a full queue returned %v instead of blocking", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	requirePop(t, q, queue, message("a"))
+	select {
+	case err := <-pushed:
+		require.NoError(t, err, "the blocked push completes once there is room")
+	case <-time.After(waitTimeout):
+		t.Fatal("blocked push did not complete after a pop")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = q.Push(ctx, queue, message("c"))
+	require.ErrorIs(t, err, context.DeadlineExceeded, "a blocked push gives up with its context")
+
+	requirePops(t, q, queue, message("b"))
+}
+
+func testOverflowDropOldest(t *testing.T, s suite) {
+	fifo, lifo := queueName(t)+"-fifo", queueName(t)+"-lifo"
+	q := s.factory(t, 3,
+		tq.WithOverflow(fifo, tq.DropOldest),
+		tq.WithOverflow(lifo, tq.DropOldest), tq.WithOrder(lifo, tq.LIFO))
+
+	a, c := message("a"), message("c")
+	b := tq.Message{Priority: 1, Data: []byte("b")}
+	d := tq.Message{Priority: 2, Data: []byte("d")}
+	for _, task := range []tq.Message{a, b, c} {
+		_, err := q.Push(context.Background(), fifo, task)
+		require.NoError(t, err)
+	}
+
+	index, err := q.Push(context.Background(), fifo, d)
+	require.NoError(t, err)
+	require.Equal(t, 0, index)
+
+	e := message("e")
+	index, err = q.Push(context.Background(), fifo, e)
+	require.NoError(t, err)
+	require.Equal(t, 2, index, "the index accounts for the dropped task")
+
+	requirePops(t, q, fifo, d, b, e)
+	if !s.supports(LIFO) {
+		return
+	}
+
+	for _, task := range messages("a", "b", "c", "d") {
+		index, err := q.Push(context.Background(), lifo, task)
+		require.NoError(t, err)
+		require.Equal(t, 0, index)
+	}
+
+	requirePops(t, q, lifo, messages("d", "c", "b")...)
+}
+
+func testRequeue(t *testing.T, s suite) {
+	overflows := []tq.Overflow{tq.Reject, tq.Block, tq.DropOldest}
+
+	for _, overflow := range overflows {
+		queue := fmt.Sprintf("%s-%d", queueName(t), overflow)
+		q := s.factory(t, 1, tq.WithOverflow(queue, overflow))
+
+		_, err := q.Push(context.Background(), queue, message("a"))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		err = q.Requeue(ctx, queue, message("b"))
+		cancel()
+		require.NoError(t, err, "requeue to a full queue under overflow %d", overflow)
+
+		requirePops(t, q, queue, messages("a", "b")...)
+	}
+}
+
+func testQueueStats(t *testing.T, s suite) {
+	fifo, lifo := queueName(t)+"-fifo", queueName(t)+"-lifo"
+	q := s.factory(t, 10, tq.WithOrder(lifo, tq.LIFO))
+
+	cases := []struct {
+		queue  string
+		oldest int
+	}{
+		{fifo, 1},
+		{lifo, 2},
+	}
+
+	for _, c := range cases {
+		if c.queue == lifo && !s.supports(LIFO) {
+			continue
+		}
+
+		stats, err := q.QueueStats(context.Background(), c.queue)
+		require.NoError(t, err, "stats of a queue that was never used")
+		require.Equal(t, tq.Stats{Queue: c.queue, At: stats.At}, stats)
+		require.WithinDuration(t, time.Now(), stats.At, time.Minute)
+
+		_, err = q.Push(context.Background(), c.queue, message("a"))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		for _, task := range []tq.Message{{Priority: 1, Data: []byte("b")}, message("c")} {
+			_, err = q.Push(context.Background(), c.queue, task)
+			require.NoError(t, err)
+		}
+
+		list, err := q.List(context.Background(), c.queue, tq.Page{})
+		require.NoError(t, err)
+		stats, err = q.QueueStats(context.Background(), c.queue)
+		require.NoError(t, err)
+		require.Equal(t, 3, stats.Length, c.queue)
+		require.Equal(t, int64(3), stats.Enqueued, c.queue)
+		require.Equal(t, int64(0), stats.Dequeued, c.queue)
+		require.True(t, list[c.oldest].Enqueued.Equal(stats.Oldest), "the oldest task of %s is the first pushed", c.queue)
+		require.GreaterOrEqual(t, stats.Age(), 50*time.Millisecond, c.queue)
+
+		requirePop(t, q, c.queue, tq.Message{Priority: 1, Data: []byte("b")})
+		stats, err = q.QueueStats(context.Background(), c.queue)
+		require.NoError(t, err)
+		require.Equal(t, 2, stats.Length, c.queue)
+		require.Equal(t, int64(1), stats.Dequeued, c.queue)
+		require.True(t, list[c.oldest].Enqueued.Equal(stats.Oldest), c.queue)
+
+		require.NoError(t, q.Pause(context.Background(), c.queue))
+		_, err = q.Delete(context.Background(), c.queue, tq.Filter{})
+		require.NoError(t, err)
+		stats, err = q.QueueStats(context.Background(), c.queue)
+		require.NoError(t, err)
+		require.True(t, stats.Paused, c.queue)
+		require.Equal(t, 0, stats.Length, c.queue)
+		require.True(t, stats.Oldest.IsZero(), "an empty queue has no oldest task")
+		require.Equal(t, time.Duration(0), stats.Age())
+		require.Equal(t, int64(3), stats.Enqueued, "counters outlive the tasks")
+		require.Equal(t, int64(1), stats.Dequeued, "deleted tasks are not dequeued")
+	}
+}
+
+func testListQueues(t *testing.T, s suite) {
+	first, second, unused := queueName(t)+"-1", queueName(t)+"-2", queueName(t)+"-3"
+	q := s.factory(t, 10)
+
+	_, err := q.Push(context.Background(), second, message("b"))
+	require.NoError(t, err)
+	_, err = q.Push(context.Background(), first, message("a"))
+	require.NoError(t, err)
+	requirePops(t, q, first, message("a"))
+
+	queues, err := q.ListQueues(context.Background())
+	require.NoError(t, err)
+	require.Contains(t, queues, first, "drained queues are listed")
+	require.Contains(t, queues, second)
+	require.NotContains(t, queues, unused)
+	require.IsIncreasing(t, queues)
+}
+
+func requirePop(t *testing.T, q tq.TaskQueue, queue string, expected tq.Message) {
+	t.Helper()
+
+	popped, err := q.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, inQueue(queue, expected)[0], received(t, popped)[0])
+}
+
+func requirePops(t *testing.T, q tq.TaskQueue, queue string, expected ...tq.Message) {
+	t.Helper()
+
+	for i, task := range inQueue(queue, expected...) {
+		popped, err := q.Pop(context.Background(), queue)
+		require.NoError(t, err, "pop %d", i)
+		require.Equal(t, task, received(t, popped)[0], "pop %d", i)
+	}
+
+	_, err := q.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue, "queue is drained")
+}
+
+// popAsync runs a blocking pop in the background and delivers the task it
+// pops, if any, on the returned channel.
+func popAsync(q tq.TaskQueue, queues ...string) <-chan tq.Message {
+	popped := make(chan tq.Message, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*waitTimeout)
+		defer cancel()
+
+		if task, err := q.BlockingPop(ctx, queues...); err == nil {
+			popped <- task
+		}
+	}()
+
+	return popped
+}
+
+func requireDelivery(t *testing.T, stream *tq.Stream) *tq.Delivery {
+	t.Helper()
+
+	select {
+	case delivery, ok := <-stream.Deliveries():
+		require.True(t, ok, "stream ended: %v", stream.Err())
+		return delivery
+	case <-time.After(waitTimeout):
+		t.Fatal("no task delivered")
+		return nil
+	}
+}
+
+func requireClosed(t *testing.T, stream *tq.Stream) {
+	t.Helper()
+
+	select {
+	case delivery, ok := <-stream.Deliveries():
+		if ok {
+			t.Fatalf("%q delivered after ctx was done", delivery.Data)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("stream not closed after ctx was done")
+	}
+}
+
+func message(data string) tq.Message {
+	return tq.Message{Data: []byte(data)}
+}
+
+func messages(data ...string) []tq.Message {
+	res := make([]tq.Message, len(data))
+	for i := range data {
+		res[i] = message(data[i])
+	}
+
+	return res
+}
+
+// received checks that the backend stamped the messages with the time they
+// were enqueued and returns copies without it and without IDs, to compare
+// them with the messages that were pushed.
+func received(t *testing.T, msgs ...tq.Message) []tq.Message {
+	t.Helper()
+
+	res := make([]tq.Message, len(msgs))
+	for i := range msgs {
+		require.False(t, msgs[i].Enqueued.IsZero(), "message %d has no enqueue time", i)
+		require.WithinDuration(t, time.Now(), msgs[i].Enqueued, time.Minute, "message %d", i)
+		res[i] = msgs[i]
+		res[i].ID = ""
+		res[i].Enqueued = time.Time{}
+	}
+
+	return res
+}
+
+// inQueue returns copies of the messages as the backend returns them from
+// queue.
+func inQueue(queue string, msgs ...tq.Message) []tq.Message {
+	res := make([]tq.Message, len(msgs))
+	for i := range msgs {
+		res[i] = msgs[i]
+		res[i].Queue = queue
+	}
+
+	return res
+}
+
+func queueName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", strings.ReplaceAll(t.Name(), "/", "-"), time.Now().UnixNano())
+}
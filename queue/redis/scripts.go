@@ -0,0 +1,282 @@
+package redis
+
+import "github.com/go-redis/redis/v8"
+
+// The scripts below run atomically on the server. Every key they touch is
+// declared in KEYS, as Redis Cluster requires: the priorities of the queue
+// come first, then the other keys of the script and last the list of every
+// priority, whose JSON array, highest first, is the first argument. See
+// List.run.
+
+// helpers are shared by the scripts. lists returns the priorities passed in
+// ARGV[1] and the key of the list of each, given the number of KEYS before
+// the lists, or nil when the queue uses a priority that was not passed, for
+// the script to fail with STALE. header decodes the JSON header of an
+// element, empty for elements written without one, which match checks
+// against a type and a table of headers.
+const helpers = `
+local function lists(first)
+	local levels, keys = cjson.decode(ARGV[1]), {}
+	for i, level in ipairs(levels) do
+		keys[level] = KEYS[first + i]
+	end
+	for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+		if not keys[tonumber(member)] then
+			return nil
+		end
+	end
+	return levels, keys
+end
+
+local function header(element)
+	local n = string.find(element, '\n', 1, true)
+	if n and string.sub(element, 1, 1) == '{' then
+		local ok, h = pcall(cjson.decode, string.sub(element, 1, n - 1))
+		if ok and type(h) == 'table' then
+			return h
+		end
+	end
+	return {}
+end
+
+local function match(h, typ, headers)
+	if typ ~= '' and h.type ~= typ then
+		return false
+	end
+	if type(headers) == 'table' then
+		local own = type(h.headers) == 'table' and h.headers or {}
+		for k, v in pairs(headers) do
+			if own[k] ~= v then
+				return false
+			end
+		end
+	end
+	return true
+end
+`
+
+// pushScript pushes an element unless the queue is full, dropping the
+// oldest element of the lowest priority first when allowed to. It returns
+// the index of the element or -1 when the queue is full.
+//
+// KEYS: priorities, stats, queue names, lists
+// ARGV: priorities, queue, priority, lifo, limit, drop oldest, element
+var pushScript = redis.NewScript(helpers + `
+local name, priority = ARGV[2], tonumber(ARGV[3])
+local lifo, limit, drop = ARGV[4] == '1', tonumber(ARGV[5]), ARGV[6] == '1'
+local levels, keys = lists(3)
+if not levels then
+	return redis.error_reply('STALE the priorities of the queue changed')
+end
+
+local length, index, lowest = 0, 0, nil
+for _, level in ipairs(levels) do
+	local n = redis.call('LLEN', keys[level])
+	length = length + n
+	if level > priority or (level == priority and not lifo) then
+		index = index + n
+	end
+	if n > 0 then
+		lowest = level
+	end
+end
+
+if limit > 0 and length >= limit then
+	if not drop or lowest == nil then
+		return -1
+	end
+
+	-- the oldest element of a list is at its right end in FIFO order and
+	-- at its left end in LIFO order.
+	if lifo then
+		redis.call('LPOP', keys[lowest])
+	else
+		redis.call('RPOP', keys[lowest])
+	end
+	if lowest > priority or (lowest == priority and not lifo) then
+		index = index - 1
+	end
+end
+
+if priority ~= 0 then
+	redis.call('ZADD', KEYS[1], priority, priority)
+end
+if lifo then
+	redis.call('RPUSH', keys[priority], ARGV[7])
+else
+	redis.call('LPUSH', keys[priority], ARGV[7])
+end
+redis.call('SADD', KEYS[3], name)
+redis.call('HINCRBY', KEYS[2], 'enqueued', 1)
+
+return index
+`)
+
+// removeScript removes the element with the given ID, derived from the
+// element like legacyID does for elements written without one. It returns 1
+// when the element was found and 0 otherwise.
+//
+// KEYS: priorities, lists
+// ARGV: priorities, id
+var removeScript = redis.NewScript(helpers + `
+local id = ARGV[2]
+local levels, keys = lists(1)
+if not levels then
+	return redis.error_reply('STALE the priorities of the queue changed')
+end
+
+for _, level in ipairs(levels) do
+	for _, element in ipairs(redis.call('LRANGE', keys[level], 0, -1)) do
+		local own = header(element).id
+		if own == nil or own == '' then
+			own = 'sha1:' .. redis.sha1hex(element)
+		end
+		if own == id then
+			redis.call('LREM', keys[level], 1, element)
+			return 1
+		end
+	end
+end
+
+return 0
+`)
+
+// popNScript pops up to n elements in pop order. It returns the priority
+// and the element of each, flattened, and -1 when the queue is paused.
+//
+// KEYS: priorities, paused queues, stats, lists
+// ARGV: priorities, queue, n
+var popNScript = redis.NewScript(helpers + `
+local name, n = ARGV[2], tonumber(ARGV[3])
+local levels, keys = lists(3)
+if not levels then
+	return redis.error_reply('STALE the priorities of the queue changed')
+end
+
+if redis.call('SISMEMBER', KEYS[2], name) == 1 then
+	return -1
+end
+
+local popped = {}
+for _, level in ipairs(levels) do
+	while #popped < 2 * n do
+		local element = redis.call('RPOP', keys[level])
+		if not element then
+			break
+		end
+		table.insert(popped, level)
+		table.insert(popped, element)
+	end
+end
+
+if #popped > 0 then
+	redis.call('HINCRBY', KEYS[3], 'dequeued', #popped / 2)
+end
+return popped
+`)
+
+// listScript lists the elements of a page in pop order. Unfiltered pages
+// only read the elements they return. It returns the priority and the
+// element of each, flattened.
+//
+// KEYS: priorities, lists
+// ARGV: priorities, filtered, type, JSON object of headers, enqueued before,
+// enqueued after, offset, limit
+var listScript = redis.NewScript(helpers + `
+local filtered, typ = ARGV[2] == '1', ARGV[3]
+local headers = cjson.decode(ARGV[4])
+local before, after = tonumber(ARGV[5]), tonumber(ARGV[6])
+local offset, limit = tonumber(ARGV[7]), tonumber(ARGV[8])
+local levels, keys = lists(1)
+if not levels then
+	return redis.error_reply('STALE the priorities of the queue changed')
+end
+
+local listed = {}
+local function full()
+	return limit > 0 and #listed >= 2 * limit
+end
+
+local function selected(element)
+	local h = header(element)
+	local enqueued = tonumber(h.enqueued) or 0
+	if before > 0 and enqueued >= before then
+		return false
+	end
+	if after > 0 and enqueued <= after then
+		return false
+	end
+	return match(h, typ, headers)
+end
+
+for _, level in ipairs(levels) do
+	if full() then
+		break
+	end
+
+	-- pop order runs from the tail of the list.
+	local k, elements = keys[level], {}
+	if filtered then
+		elements = redis.call('LRANGE', k, 0, -1)
+	else
+		local length = redis.call('LLEN', k)
+		local last = length - offset - 1
+		offset = math.max(0, offset - length)
+		if last >= 0 then
+			local first = 0
+			if limit > 0 then
+				first = math.max(0, last - (limit - #listed / 2) + 1)
+			end
+			elements = redis.call('LRANGE', k, first, last)
+		end
+	end
+
+	for i = #elements, 1, -1 do
+		if full() then
+			break
+		end
+		if not filtered or selected(elements[i]) then
+			if offset > 0 then
+				offset = offset - 1
+			else
+				table.insert(listed, level)
+				table.insert(listed, elements[i])
+			end
+		end
+	end
+end
+
+return listed
+`)
+
+// popFilterScript pops the first element in pop order whose type and
+// headers match. It returns the priority and the element, 0 when none
+// matches and -1 when the queue is paused.
+//
+// KEYS: priorities, paused queues, stats, lists
+// ARGV: priorities, queue, type, JSON object of headers
+var popFilterScript = redis.NewScript(helpers + `
+local name, typ = ARGV[2], ARGV[3]
+local headers = cjson.decode(ARGV[4])
+local levels, keys = lists(3)
+if not levels then
+	return redis.error_reply('STALE the priorities of the queue changed')
+end
+
+if redis.call('SISMEMBER', KEYS[2], name) == 1 then
+	return -1
+end
+
+for _, level in ipairs(levels) do
+	local elements = redis.call('LRANGE', keys[level], 0, -1)
+	for i = #elements, 1, -1 do
+		if match(header(elements[i]), typ, headers) then
+			redis.call('LREM', keys[level], -1, elements[i])
+			redis.call('HINCRBY', KEYS[3], 'dequeued', 1)
+			return {level, elements[i]}
+		end
+	end
+end
+
+return 0
+`)
@@ -1,96 +1,857 @@
 package redis
 
 import (
-	"github.com/ZutrixPog/dispatcher"
-	"github.com/ZutrixPog/dispatcher/queue"
-	"github.com/go-redis/redis"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	popTimeout   = time.Second
+	pushInterval = 100 * time.Millisecond
+	txRetries    = 10
 )
 
-var _ queue.TaskQueue = (*List)(nil)
+var _ tq.TaskQueue = (*List)(nil)
 
+// List stores every priority of a queue in its own redis list. Priority 0
+// keeps using the plain queue key so queues written by earlier versions stay
+// readable, and the other priorities in use are tracked in a sorted set.
+// Tasks are always popped from the right end of a list; the queue order
+// decides which end they are pushed to. Every element is a JSON header with
+// the task ID, type and headers, a newline and the payload.
 type List struct {
-	client *redis.Client
+	client redis.UniversalClient
+	keys   keyspace
 	limit  int64
+	config tq.Config
+}
+
+// NewTaskQueue accepts any client of a standalone, Sentinel or Cluster
+// deployment. Cluster deployments need a namespace, see keyspace.
+func NewTaskQueue(client redis.UniversalClient, limit int64, opts ...tq.Option) tq.TaskQueue {
+	config := tq.NewConfig(opts...)
+
+	return &List{client, keyspace(config.Namespace()), limit, config}
+}
+
+// Push polls a full queue with the Block overflow policy until it has room.
+func (q *List) Push(ctx context.Context, queue string, ts tq.Message) (int, error) {
+	if err := q.keys.check(queue); err != nil {
+		return 0, err
+	}
+
+	for {
+		index, err := q.push(ctx, queue, ts, true)
+		if err != nil && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != tq.ErrFullQueue || q.config.Overflow(queue) != tq.Block {
+			return index, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(pushInterval):
+		}
+	}
 }
 
-func NewTaskQueue(client *redis.Client, limit int64) queue.TaskQueue {
-	return &List{client, limit}
+func (q *List) Requeue(ctx context.Context, queue string, ts tq.Message) error {
+	if err := q.keys.check(queue); err != nil {
+		return err
+	}
+
+	_, err := q.push(ctx, queue, ts, false)
+	return err
 }
 
-func (q *List) Push(queue string, ts []byte) (int, error) {
-	length, err := q.client.LLen(queue).Result()
+// push runs pushScript, so that concurrent producers can not exceed the
+// limit between checking the length of the queue and pushing to it. The
+// queue is taken as unlimited unless bounded.
+func (q *List) push(ctx context.Context, queue string, ts tq.Message, bounded bool) (int, error) {
+	ts.ID = newID()
+	ts.Enqueued = time.Now()
+	lifo := q.config.Order(queue) == tq.LIFO
+	drop := q.config.Overflow(queue) == tq.DropOldest
+	var limit int64
+	if bounded {
+		limit = q.config.Limit(queue, q.limit)
+	}
+	keys := []string{q.keys.priorities(queue), q.keys.stats(queue), q.keys.queues()}
+
+	index, err := q.run(ctx, pushScript, queue, keys, []int{ts.Priority},
+		queue, ts.Priority, flag(lifo), limit, flag(drop), encode(ts)).Int64()
 	if err != nil {
-		return 0, dispatcher.ErrCreateEntity
+		return 0, tq.ErrCreateEntity
 	}
-	if length >= q.limit && queue != dispatcher.BgQueue {
-		return 0, dispatcher.ErrFullQueue
+	if index < 0 {
+		return 0, tq.ErrFullQueue
 	}
 
-	if err = q.client.LPush(queue, ts).Err(); err != nil {
-		return 0, dispatcher.ErrCreateEntity
+	return int(index), nil
+}
+
+// Pop runs the script of PopN, so the pause check, the pop and the dequeue
+// counter are atomic.
+func (q *List) Pop(ctx context.Context, queue string) (tq.Message, error) {
+	tasks, err := q.PopN(ctx, queue, 1)
+	if err != nil {
+		return tq.Message{}, err
 	}
 
-	return int(length), nil
+	return tasks[0], nil
 }
 
-func (q *List) Pop(queue string) ([]byte, error) {
-	data, err := q.client.RPop(queue).Result()
+// PopN pops the tasks in a single script, so a batch takes one round trip.
+func (q *List) PopN(ctx context.Context, queue string, n int) ([]tq.Message, error) {
+	if err := q.keys.check(queue); err != nil {
+		return nil, err
+	}
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	keys := []string{q.keys.priorities(queue), q.keys.paused(), q.keys.stats(queue)}
+	res, err := q.run(ctx, popNScript, queue, keys, nil, queue, n).Result()
 	if err != nil {
-		return nil, dispatcher.ErrEmptyQueue
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	popped, ok := res.([]interface{})
+	if !ok {
+		return nil, tq.ErrQueuePaused
+	}
+	if len(popped) == 0 {
+		return nil, tq.ErrEmptyQueue
 	}
 
-	return []byte(data), err
+	tasks := make([]tq.Message, 0, len(popped)/2)
+	for i := 0; i+1 < len(popped); i += 2 {
+		level, _ := popped[i].(int64)
+		element, _ := popped[i+1].(string)
+		tasks = append(tasks, decode(queue, int(level), element))
+	}
+	return tasks, nil
 }
 
-func (q *List) BlockingPop(queue string) <-chan []byte {
-	waitchan := make(chan []byte)
-	go func() {
-		data, err := q.client.BRPop(0, queue).Result()
+func (q *List) PopFilter(ctx context.Context, queue string, filter tq.Filter) (tq.Message, error) {
+	if err := q.keys.check(queue); err != nil {
+		return tq.Message{}, err
+	}
+
+	headers, _ := json.Marshal(filter.Headers)
+	keys := []string{q.keys.priorities(queue), q.keys.paused(), q.keys.stats(queue)}
+
+	res, err := q.run(ctx, popFilterScript, queue, keys, nil, queue, filter.Type, headers).Result()
+	if err != nil {
+		return tq.Message{}, tq.ErrRetrieveEntity
+	}
+
+	popped, ok := res.([]interface{})
+	if !ok {
+		if res == int64(-1) {
+			return tq.Message{}, tq.ErrQueuePaused
+		}
+		return tq.Message{}, tq.ErrEmptyQueue
+	}
+
+	level, _ := popped[0].(int64)
+	element, _ := popped[1].(string)
+	return decode(queue, int(level), element), nil
+}
+
+// BlockingPop waits on every priority of the queues at once. The wait is cut
+// into short rounds so that priorities first used and queues paused or
+// resumed while waiting are picked up, and ctx is checked between them: a
+// round cancelled halfway could pop a task without returning it.
+func (q *List) BlockingPop(ctx context.Context, queues ...string) (tq.Message, error) {
+	if err := q.keys.check(queues...); err != nil {
+		return tq.Message{}, err
+	}
+
+	round := context.Background()
+	for {
+		if err := ctx.Err(); err != nil {
+			return tq.Message{}, err
+		}
+
+		paused, err := q.client.SMembers(round, q.keys.paused()).Result()
 		if err != nil {
-			waitchan <- nil
-			return
+			return tq.Message{}, tq.ErrRetrieveEntity
 		}
-		waitchan <- []byte(data[1])
-	}()
 
-	return waitchan
+		var keys []string
+		var messages []tq.Message
+		for _, queue := range queues {
+			if contains(paused, queue) {
+				continue
+			}
+
+			levels, err := q.levels(round, queue)
+			if err != nil {
+				return tq.Message{}, tq.ErrRetrieveEntity
+			}
+
+			for _, level := range levels {
+				keys = append(keys, q.keys.key(queue, level))
+				messages = append(messages, tq.Message{Queue: queue, Priority: level})
+			}
+		}
+
+		if len(keys) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(popTimeout):
+			}
+			continue
+		}
+
+		data, err := q.client.BRPop(round, popTimeout, keys...).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return tq.Message{}, tq.ErrRetrieveEntity
+		}
+
+		for i := range keys {
+			if keys[i] != data[0] {
+				continue
+			}
+
+			// the queue may have been paused while waiting, in which case
+			// the task goes back to the end it was popped from.
+			if paused, _ := q.Paused(round, messages[i].Queue); paused {
+				q.client.RPush(round, data[0], data[1])
+				break
+			}
+
+			q.client.HIncrBy(round, q.keys.stats(messages[i].Queue), "dequeued", 1)
+			return decode(messages[i].Queue, messages[i].Priority, data[1]), nil
+		}
+	}
 }
 
-func (q *List) Get(queue string, index int) ([]byte, error) {
-	data, err := q.client.LIndex(queue, int64(index)).Result()
+func (q *List) Get(ctx context.Context, queue string, index int) (tq.Message, error) {
+	if err := q.keys.check(queue); err != nil {
+		return tq.Message{}, err
+	}
+
+	level, offset, err := q.locate(ctx, queue, index)
 	if err != nil {
-		return nil, dispatcher.ErrEntityNotFound
+		return tq.Message{}, err
 	}
 
-	return []byte(data), err
+	data, err := q.client.LIndex(ctx, q.keys.key(queue, level), offset).Result()
+	if err != nil {
+		return tq.Message{}, tq.ErrEntityNotFound
+	}
+
+	return decode(queue, level, data), err
 }
 
-func (q *List) List(queue string) ([][]byte, error) {
-	data, err := q.client.LRange(queue, 0, q.limit).Result()
-	if err != nil {
-		return nil, dispatcher.ErrRetrieveEntity
+// List reads the page in a single script, so only the tasks of the page
+// leave the server.
+func (q *List) List(ctx context.Context, queue string, page tq.Page) ([]tq.Message, error) {
+	if err := q.keys.check(queue); err != nil {
+		return nil, err
+	}
+
+	headers, _ := json.Marshal(page.Headers)
+	var before, after int64
+	if !page.Before.IsZero() {
+		before = page.Before.UnixNano()
 	}
-	if len(data) == 0 {
-		return nil, dispatcher.ErrEmptyQueue
+	if !page.After.IsZero() {
+		after = page.After.UnixNano()
 	}
 
-	ts := make([][]byte, len(data))
-	for i, taskData := range data {
-		ts[i] = []byte(taskData)
+	res, err := q.run(ctx, listScript, queue, []string{q.keys.priorities(queue)}, nil,
+		flag(!page.Unfiltered()), page.Type, headers, before, after, page.Offset, page.Limit).Result()
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	listed, _ := res.([]interface{})
+	if len(listed) == 0 {
+		return nil, tq.ErrEmptyQueue
 	}
 
+	ts := make([]tq.Message, 0, len(listed)/2)
+	for i := 0; i+1 < len(listed); i += 2 {
+		level, _ := listed[i].(int64)
+		element, _ := listed[i+1].(string)
+		ts = append(ts, decode(queue, int(level), element))
+	}
 	return ts, nil
 }
 
-func (q *List) Remove(queue string, index int) error {
-	tag := "DELETED"
-	if err := q.client.LSet(queue, int64(index), tag).Err(); err != nil {
-		return dispatcher.ErrEntityNotFound
+// Remove removes the task found at the index by its ID, so a task popped in
+// between is not mistaken for another one.
+func (q *List) Remove(ctx context.Context, queue string, index int) error {
+	if err := q.keys.check(queue); err != nil {
+		return err
+	}
+
+	ts, err := q.Get(ctx, queue, index)
+	if err != nil {
+		return err
+	}
+
+	return q.RemoveID(ctx, queue, ts.ID)
+}
+
+func (q *List) RemoveID(ctx context.Context, queue string, id string) error {
+	if err := q.keys.check(queue); err != nil {
+		return err
+	}
+
+	removed, err := q.run(ctx, removeScript, queue, []string{q.keys.priorities(queue)}, nil, id).Int64()
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+	if removed == 0 {
+		return tq.ErrEntityNotFound
+	}
+
+	return nil
+}
+
+func (q *List) Pause(ctx context.Context, queue string) error {
+	if err := q.keys.check(queue); err != nil {
+		return err
+	}
+
+	if err := q.client.SAdd(ctx, q.keys.paused(), queue).Err(); err != nil {
+		return tq.ErrCreateEntity
+	}
+
+	return nil
+}
+
+func (q *List) Resume(ctx context.Context, queue string) error {
+	if err := q.keys.check(queue); err != nil {
+		return err
+	}
+
+	if err := q.client.SRem(ctx, q.keys.paused(), queue).Err(); err != nil {
+		return tq.ErrRemoveEntity
+	}
+
+	return nil
+}
+
+func (q *List) Paused(ctx context.Context, queue string) (bool, error) {
+	if err := q.keys.check(queue); err != nil {
+		return false, err
+	}
+
+	paused, err := q.client.SIsMember(ctx, q.keys.paused(), queue).Result()
+	if err != nil {
+		return false, tq.ErrRetrieveEntity
+	}
+
+	return paused, nil
+}
+
+func (q *List) Delete(ctx context.Context, queue string, filter tq.Filter) ([]tq.Message, error) {
+	if err := q.keys.check(queue); err != nil {
+		return nil, err
+	}
+
+	var removed []tq.Message
+	err := q.transaction(ctx, func(tx *redis.Tx) error {
+		levels, lists, err := q.snapshot(ctx, tx, queue)
+		if err != nil {
+			return err
+		}
+
+		var kept [][]string
+		kept, removed = split(queue, levels, lists, filter)
+		if len(removed) == 0 {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			q.replace(ctx, pipe, queue, levels, kept)
+			return nil
+		})
+		return err
+	}, q.keys.priorities(queue))
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return removed, nil
+}
+
+func (q *List) Move(ctx context.Context, from, to string, filter tq.Filter) ([]tq.Message, error) {
+	if err := q.keys.check(from, to); err != nil {
+		return nil, err
+	}
+
+	if from == to {
+		return nil, nil
+	}
+
+	var moved []tq.Message
+	err := q.transaction(ctx, func(tx *redis.Tx) error {
+		levels, lists, err := q.snapshot(ctx, tx, from)
+		if err != nil {
+			return err
+		}
+		_, target, err := q.snapshot(ctx, tx, to)
+		if err != nil {
+			return err
+		}
+
+		var kept [][]string
+		kept, moved = split(from, levels, lists, filter)
+		if len(moved) == 0 {
+			return nil
+		}
+
+		length := 0
+		for _, list := range target {
+			length += len(list)
+		}
+		if q.config.Full(to, length, len(moved), q.limit) {
+			return tq.ErrFullQueue
+		}
+
+		lifo := q.config.Order(to) == tq.LIFO
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			q.replace(ctx, pipe, from, levels, kept)
+			for _, ts := range moved {
+				if ts.Priority != 0 {
+					pipe.ZAdd(ctx, q.keys.priorities(to), &redis.Z{Score: float64(ts.Priority), Member: ts.Priority})
+				}
+				q.add(ctx, pipe, to, ts, lifo)
+			}
+			return nil
+		})
+		return err
+	}, q.keys.priorities(from), q.keys.priorities(to))
+	if err == tq.ErrFullQueue {
+		return nil, err
+	}
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return moved, nil
+}
+
+func (q *List) ListQueues(ctx context.Context) ([]string, error) {
+	queues, err := q.client.SMembers(ctx, q.keys.queues()).Result()
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+	sort.Strings(queues)
+
+	return queues, nil
+}
+
+// QueueStats reads the oldest task of every priority, which sits at the
+// pop end of its list in FIFO order and at the other end in LIFO order.
+func (q *List) QueueStats(ctx context.Context, queue string) (tq.Stats, error) {
+	if err := q.keys.check(queue); err != nil {
+		return tq.Stats{}, err
+	}
+
+	levels, err := q.levels(ctx, queue)
+	if err != nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+
+	oldest := int64(-1)
+	if q.config.Order(queue) == tq.LIFO {
+		oldest = 0
+	}
+	lengths := make([]*redis.IntCmd, len(levels))
+	heads := make([]*redis.StringCmd, len(levels))
+	var paused *redis.BoolCmd
+	var counters *redis.StringStringMapCmd
+	_, err = q.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, level := range levels {
+			lengths[i] = pipe.LLen(ctx, q.keys.key(queue, level))
+			heads[i] = pipe.LIndex(ctx, q.keys.key(queue, level), oldest)
+		}
+		paused = pipe.SIsMember(ctx, q.keys.paused(), queue)
+		counters = pipe.HGetAll(ctx, q.keys.stats(queue))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+
+	stats := tq.Stats{Queue: queue, Paused: paused.Val(), At: time.Now()}
+	stats.Enqueued, _ = strconv.ParseInt(counters.Val()["enqueued"], 10, 64)
+	stats.Dequeued, _ = strconv.ParseInt(counters.Val()["dequeued"], 10, 64)
+	for i, level := range levels {
+		stats.Length += int(lengths[i].Val())
+		if heads[i].Err() != nil {
+			continue
+		}
+
+		enqueued := decode(queue, level, heads[i].Val()).Enqueued
+		if !enqueued.IsZero() && (stats.Oldest.IsZero() || enqueued.Before(stats.Oldest)) {
+			stats.Oldest = enqueued
+		}
+	}
+
+	return stats, nil
+}
+
+// transaction runs fn watching the keys, retrying when a watched key
+// changes before the transaction commits.
+func (q *List) transaction(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < txRetries; i++ {
+		err := q.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// snapshot watches every list of the queue and returns the priorities in
+// use with the raw elements of their lists.
+func (q *List) snapshot(ctx context.Context, tx *redis.Tx, queue string) ([]int, [][]string, error) {
+	members, err := tx.ZRange(ctx, q.keys.priorities(queue), 0, -1).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	levels, err := parseLevels(members)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, len(levels))
+	for i, level := range levels {
+		keys[i] = q.keys.key(queue, level)
+	}
+	if err := tx.Watch(ctx, keys...).Err(); err != nil {
+		return nil, nil, err
+	}
+
+	lists := make([][]string, len(levels))
+	for i := range keys {
+		lists[i], err = tx.LRange(ctx, keys[i], 0, -1).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return levels, lists, nil
+}
+
+// split separates the elements matching the filter from the others. The
+// kept elements stay in list order and the matching ones are returned in
+// pop order.
+func split(queue string, levels []int, lists [][]string, filter tq.Filter) ([][]string, []tq.Message) {
+	kept := make([][]string, len(lists))
+	var matched []tq.Message
+	for i, list := range lists {
+		for j := len(list) - 1; j >= 0; j-- {
+			ts := decode(queue, levels[i], list[j])
+			if filter.Match(ts) {
+				matched = append(matched, ts)
+			} else {
+				kept[i] = append(kept[i], list[j])
+			}
+		}
+
+		for l, r := 0, len(kept[i])-1; l < r; l, r = l+1, r-1 {
+			kept[i][l], kept[i][r] = kept[i][r], kept[i][l]
+		}
+	}
+
+	return kept, matched
+}
+
+// replace rewrites the lists of the queue with the given elements.
+func (q *List) replace(ctx context.Context, pipe redis.Pipeliner, queue string, levels []int, lists [][]string) {
+	for i, level := range levels {
+		pipe.Del(ctx, q.keys.key(queue, level))
+		if len(lists[i]) == 0 {
+			continue
+		}
+
+		elements := make([]interface{}, len(lists[i]))
+		for j := range lists[i] {
+			elements[j] = lists[i][j]
+		}
+		pipe.RPush(ctx, q.keys.key(queue, level), elements...)
+	}
+}
+
+// levels returns the priorities in use by the queue, highest first.
+func (q *List) levels(ctx context.Context, queue string) ([]int, error) {
+	members, err := q.client.ZRange(ctx, q.keys.priorities(queue), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLevels(members)
+}
+
+// run runs a script over the lists of the queue, declaring the list of
+// every priority in use and of the extra ones in KEYS after the given keys,
+// and passing the priorities as the first argument. The script fails with
+// STALE when the queue starts using another priority in between, and is run
+// again.
+func (q *List) run(ctx context.Context, script *redis.Script, queue string, keys []string, extra []int, args ...interface{}) *redis.Cmd {
+	var cmd *redis.Cmd
+	for i := 0; i < txRetries; i++ {
+		levels, err := q.levels(ctx, queue)
+		if err != nil {
+			cmd = redis.NewCmd(ctx)
+			cmd.SetErr(err)
+			return cmd
+		}
+		for _, level := range extra {
+			if !containsLevel(levels, level) {
+				levels = append(levels, level)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+
+		lists := append([]string{}, keys...)
+		for _, level := range levels {
+			lists = append(lists, q.keys.key(queue, level))
+		}
+		encoded, _ := json.Marshal(levels)
+
+		cmd = script.Run(ctx, q.client, lists, append([]interface{}{string(encoded)}, args...)...)
+		if err := cmd.Err(); err == nil || !strings.HasPrefix(err.Error(), "STALE") {
+			return cmd
+		}
+	}
+
+	return cmd
+}
+
+func containsLevel(levels []int, level int) bool {
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseLevels(members []string) ([]int, error) {
+	levels := []int{0}
+	for _, member := range members {
+		level, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, err
+		}
+		if level != 0 {
+			levels = append(levels, level)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+
+	return levels, nil
+}
+
+func (q *List) lengths(ctx context.Context, queue string) ([]int, []int64, error) {
+	levels, err := q.levels(ctx, queue)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmds := make([]*redis.IntCmd, len(levels))
+	_, err = q.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, level := range levels {
+			cmds[i] = pipe.LLen(ctx, q.keys.key(queue, level))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lengths := make([]int64, len(levels))
+	for i := range cmds {
+		lengths[i] = cmds[i].Val()
+	}
+
+	return levels, lengths, nil
+}
+
+// locate translates an index in pop order to a priority and a list offset.
+func (q *List) locate(ctx context.Context, queue string, index int) (int, int64, error) {
+	levels, lengths, err := q.lengths(ctx, queue)
+	if err != nil {
+		return 0, 0, tq.ErrRetrieveEntity
+	}
+
+	offset := int64(index)
+	for i, level := range levels {
+		if offset >= 0 && offset < lengths[i] {
+			return level, -offset - 1, nil
+		}
+		offset -= lengths[i]
+	}
+
+	return 0, 0, tq.ErrEntityNotFound
+}
+
+func (q *List) add(ctx context.Context, pipe redis.Pipeliner, queue string, ts tq.Message, lifo bool) {
+	ts.Enqueued = time.Now()
+	pipe.SAdd(ctx, q.keys.queues(), queue)
+	pipe.HIncrBy(ctx, q.keys.stats(queue), "enqueued", 1)
+	if lifo {
+		pipe.RPush(ctx, q.keys.key(queue, ts.Priority), encode(ts))
+	} else {
+		pipe.LPush(ctx, q.keys.key(queue, ts.Priority), encode(ts))
 	}
+}
+
+type header struct {
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Enqueued int64             `json:"enqueued,omitempty"`
+}
 
-	if err := q.client.LRem(queue, 1, tag).Err(); err != nil {
-		return dispatcher.ErrRemoveEntity
+func encode(ts tq.Message) []byte {
+	data, _ := json.Marshal(header{ID: ts.ID, Type: ts.Type, Headers: ts.Headers, Enqueued: ts.Enqueued.UnixNano()})
+	data = append(data, '\n')
+
+	return append(data, ts.Data...)
+}
+
+// decode reads an element written by encode. Elements without a header,
+// written by earlier versions, are read as a bare payload, and elements
+// without an ID are given the one legacyID derives from them.
+func decode(queue string, priority int, element string) tq.Message {
+	ts := tq.Message{Queue: queue, Priority: priority, Data: []byte(element)}
+
+	var h header
+	end := bytes.IndexByte(ts.Data, '\n')
+	if end < 0 || ts.Data[0] != '{' || json.Unmarshal(ts.Data[:end], &h) != nil {
+		ts.ID = legacyID(element)
+		return ts
+	}
+
+	ts.ID, ts.Type, ts.Headers, ts.Data = h.ID, h.Type, h.Headers, ts.Data[end+1:]
+	if ts.ID == "" {
+		ts.ID = legacyID(element)
+	}
+	if h.Enqueued != 0 {
+		ts.Enqueued = time.Unix(0, h.Enqueued)
+	}
+	return ts
+}
+
+// legacyID identifies an element written without an ID by the SHA-1 of the
+// element, as removeScript does.
+func legacyID(element string) string {
+	sum := sha1.Sum([]byte(element))
+	return "sha1:" + hex.EncodeToString(sum[:])
+}
+
+// newID returns a random ID, which also keeps every element of a list
+// unique so that it can be removed by value.
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func flag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func contains(queues []string, queue string) bool {
+	for i := range queues {
+		if queues[i] == queue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keyspace names the keys of a namespace. Without a namespace the keys are
+// named as by earlier versions. Otherwise every key starts with the
+// namespace as a hash tag, so the keys of a namespace share a Cluster hash
+// slot and blocking pops of several queues, moves and scripts keep working;
+// separate namespaces spread the load over the nodes.
+//
+// The keys of the metadata of a queue append a colon and a suffix to the
+// queue name and those of every queue are named pausedKey and queuesKey, so
+// queue names containing a colon or a brace, or named like those keys, are
+// rejected with ErrInvalidQueueName rather than sharing their keys.
+type keyspace string
+
+const (
+	pausedKey = "paused-queues"
+	queuesKey = "queue-names"
+)
+
+// check rejects the queue names that could share keys with other queues or
+// the metadata.
+func (ks keyspace) check(queues ...string) error {
+	for _, queue := range queues {
+		if strings.ContainsAny(queue, ":{}") || queue == pausedKey || queue == queuesKey {
+			return tq.ErrInvalidQueueName
+		}
 	}
 
 	return nil
 }
+
+func (ks keyspace) key(queue string, priority int) string {
+	if priority == 0 {
+		return ks.prefix() + queue
+	}
+	return fmt.Sprintf("%s%s:%d", ks.prefix(), queue, priority)
+}
+
+func (ks keyspace) stats(queue string) string {
+	return ks.prefix() + queue + ":stats"
+}
+
+func (ks keyspace) priorities(queue string) string {
+	return ks.prefix() + queue + ":priorities"
+}
+
+func (ks keyspace) paused() string {
+	return ks.prefix() + pausedKey
+}
+
+func (ks keyspace) queues() string {
+	return ks.prefix() + queuesKey
+}
+
+func (ks keyspace) prefix() string {
+	if ks == "" {
+		return ""
+	}
+	return "{" + string(ks) + "}:"
+}
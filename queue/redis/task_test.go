@@ -1,8 +1,13 @@
 package redis_test
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/queuetest"
 	"github.com/ZutrixPog/dispatcher/queue/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -11,8 +16,8 @@ import (
 )
 
 var (
-	task1 = []byte{}
-	task2 = []byte{}
+	task1 = tq.Message{Data: []byte{}}
+	task2 = tq.Message{Data: []byte{}}
 )
 
 func TestList_Push(t *testing.T) {
@@ -20,13 +25,13 @@ func TestList_Push(t *testing.T) {
 
 	fullQueue := "full"
 	for i := 0; i < 11; i++ {
-		queue.Push(fullQueue, task1)
+		queue.Push(context.Background(), fullQueue, task1)
 	}
 
 	cases := []struct {
 		desc        string
 		queue       string
-		task        []byte
+		task        tq.Message
 		expectedErr error
 	}{
 		{
@@ -45,14 +50,14 @@ func TestList_Push(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.desc, func(t *testing.T) {
-			id, err := queue.Push(c.queue, c.task)
+			id, err := queue.Push(context.Background(), c.queue, c.task)
 			if c.expectedErr != nil {
 				require.Error(t, err, c.desc)
 				assert.Equal(t, c.expectedErr, err, c.desc)
 			} else {
 				require.NoError(t, err, c.desc)
 				assert.Equal(t, id, 0, c.desc)
-				task, err := queue.Get("queue", 0)
+				task, err := queue.Get(context.Background(), "queue", 0)
 				assert.Nil(t, err)
 				assert.NotNil(t, task)
 			}
@@ -64,7 +69,7 @@ func TestList_Pop(t *testing.T) {
 	queue := redis.NewTaskQueue(client, 10)
 
 	nonEmptyQueue := "queue"
-	queue.Push(nonEmptyQueue, task1)
+	queue.Push(context.Background(), nonEmptyQueue, task1)
 
 	cases := []struct {
 		desc        string
@@ -90,7 +95,7 @@ func TestList_Pop(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.desc, func(t *testing.T) {
-			_, err := queue.Pop(c.queue)
+			_, err := queue.Pop(context.Background(), c.queue)
 			if c.expectedErr != nil {
 				require.Error(t, err)
 				assert.Equal(t, c.expectedErr, err)
@@ -106,48 +111,48 @@ func TestList_Get(t *testing.T) {
 	queue := redis.NewTaskQueue(client, 10)
 
 	validQueue := "queue"
-	queue.Push(validQueue, task1)
-	queue.Push(validQueue, task2)
+	queue.Push(context.Background(), validQueue, task1)
+	queue.Push(context.Background(), validQueue, task2)
 
 	cases := []struct {
 		desc        string
 		queue       string
 		index       int
-		expected    []byte
+		expected    tq.Message
 		expectedErr error
 	}{
 		{
 			desc:        "Get task from a valid queue",
 			queue:       validQueue,
 			index:       0,
-			expected:    task2,
+			expected:    tq.Message{Queue: validQueue, Data: task2.Data},
 			expectedErr: nil,
 		},
 		{
 			desc:        "Get task from a non-existent queue",
 			queue:       "nonExistentQueue",
 			index:       0,
-			expected:    nil,
+			expected:    tq.Message{},
 			expectedErr: errors.ErrEntityNotFound,
 		},
 		{
 			desc:        "Get task at an invalid index",
 			queue:       validQueue,
 			index:       100,
-			expected:    nil,
+			expected:    tq.Message{},
 			expectedErr: errors.ErrEntityNotFound,
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.desc, func(t *testing.T) {
-			ts, err := queue.Get(c.queue, c.index)
+			ts, err := queue.Get(context.Background(), c.queue, c.index)
 			if c.expectedErr != nil {
 				require.Error(t, err)
 				assert.Equal(t, c.expectedErr, err)
 			} else {
-				require.Equal(t, c.expected, ts)
 				require.NoError(t, err)
+				require.Equal(t, c.expected, withoutEnqueued(ts)[0])
 			}
 		})
 	}
@@ -158,7 +163,7 @@ func TestList_List(t *testing.T) {
 
 	validQueue := "queue"
 	for i := 0; i < 5; i++ {
-		queue.Push(validQueue, task1)
+		queue.Push(context.Background(), validQueue, task1)
 	}
 
 	cases := []struct {
@@ -183,7 +188,7 @@ func TestList_List(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.desc, func(t *testing.T) {
-			ts, err := queue.List(c.queue)
+			ts, err := queue.List(context.Background(), c.queue, tq.Page{})
 			if c.expectedErr != nil {
 				require.Error(t, err)
 				assert.Equal(t, c.expectedErr, err)
@@ -199,8 +204,8 @@ func TestList_Remove(t *testing.T) {
 	queue := redis.NewTaskQueue(client, 10)
 
 	nonEmptyQueue := "queue"
-	id, _ := queue.Push(nonEmptyQueue, task2)
-	queue.Push(nonEmptyQueue, task1)
+	id, _ := queue.Push(context.Background(), nonEmptyQueue, task2)
+	queue.Push(context.Background(), nonEmptyQueue, task1)
 
 	cases := []struct {
 		desc        string
@@ -230,7 +235,7 @@ func TestList_Remove(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.desc, func(t *testing.T) {
-			err := queue.Remove(c.queue, c.index)
+			err := queue.Remove(context.Background(), c.queue, c.index)
 			if c.expectedErr != nil {
 				require.Error(t, err)
 				assert.Equal(t, c.expectedErr, err)
@@ -240,6 +245,193 @@ func TestList_Remove(t *testing.T) {
 		})
 	}
 
-	task, _ := queue.Pop(nonEmptyQueue)
-	require.Equal(t, task1, task)
+	task, _ := queue.Pop(context.Background(), nonEmptyQueue)
+	require.Equal(t, task1.Data, task.Data)
+}
+
+func TestList_RemoveLegacy(t *testing.T) {
+	queue := redis.NewTaskQueue(client, 10)
+
+	legacyQueue := "legacy"
+	require.NoError(t, client.Del(context.Background(), legacyQueue).Err())
+	require.NoError(t, client.LPush(context.Background(), legacyQueue, "old", "old", "DELETED").Err())
+	_, err := queue.Push(context.Background(), legacyQueue, tq.Message{Data: []byte("new")})
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Remove(context.Background(), legacyQueue, 1), "remove an element written without an ID")
+	require.NoError(t, queue.Remove(context.Background(), legacyQueue, 2), "remove the new element by its ID")
+
+	ts, err := queue.List(context.Background(), legacyQueue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, []tq.Message{
+		{Queue: legacyQueue, Data: []byte("old")},
+		{Queue: legacyQueue, Data: []byte("DELETED")},
+	}, withoutEnqueued(ts...))
+}
+
+func TestList_Priority(t *testing.T) {
+	queue := redis.NewTaskQueue(client, 10)
+
+	priorityQueue := "priority"
+	low := tq.Message{Queue: priorityQueue, Priority: -1, Data: []byte("low")}
+	normal := tq.Message{Queue: priorityQueue, Data: []byte("normal")}
+	high := tq.Message{Queue: priorityQueue, Priority: 5, Data: []byte("high")}
+	urgent := tq.Message{Queue: priorityQueue, Priority: 5, Data: []byte("urgent")}
+
+	cases := []struct {
+		desc  string
+		task  tq.Message
+		index int
+	}{
+		{
+			desc:  "Push a task with the default priority",
+			task:  normal,
+			index: 0,
+		},
+		{
+			desc:  "Push a low priority task",
+			task:  low,
+			index: 1,
+		},
+		{
+			desc:  "Push a high priority task",
+			task:  high,
+			index: 0,
+		},
+		{
+			desc:  "Push a task with the same high priority",
+			task:  urgent,
+			index: 1,
+		},
+	}
+
+	for _, c := range cases {
+		index, err := queue.Push(context.Background(), priorityQueue, c.task)
+		require.NoError(t, err, c.desc)
+		assert.Equal(t, c.index, index, c.desc)
+	}
+
+	ts, err := queue.List(context.Background(), priorityQueue, tq.Page{})
+	require.NoError(t, err)
+	require.Equal(t, []tq.Message{high, urgent, normal, low}, withoutEnqueued(ts...))
+
+	task, err := queue.Get(context.Background(), priorityQueue, 2)
+	require.NoError(t, err)
+	require.Equal(t, normal, withoutEnqueued(task)[0])
+
+	for _, expected := range []tq.Message{high, urgent, normal, low} {
+		task, err := queue.Pop(context.Background(), priorityQueue)
+		require.NoError(t, err)
+		require.Equal(t, expected, withoutEnqueued(task)[0])
+	}
+}
+
+func TestList_Order(t *testing.T) {
+	fifoQueue, lifoQueue := "fifo", "lifo"
+	queue := redis.NewTaskQueue(client, 10, tq.WithOrder(lifoQueue, tq.LIFO))
+
+	first := tq.Message{Data: []byte("first")}
+	second := tq.Message{Data: []byte("second")}
+	urgent := tq.Message{Priority: 1, Data: []byte("urgent")}
+
+	cases := []struct {
+		desc    string
+		queue   string
+		indexes []int
+		popped  []tq.Message
+	}{
+		{
+			desc:    "Pop tasks from a FIFO queue",
+			queue:   fifoQueue,
+			indexes: []int{0, 1, 0},
+			popped:  []tq.Message{urgent, first, second},
+		},
+		{
+			desc:    "Pop tasks from a LIFO queue",
+			queue:   lifoQueue,
+			indexes: []int{0, 0, 0},
+			popped:  []tq.Message{urgent, second, first},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			for i, task := range []tq.Message{first, second, urgent} {
+				index, err := queue.Push(context.Background(), c.queue, task)
+				require.NoError(t, err)
+				assert.Equal(t, c.indexes[i], index)
+			}
+
+			ts, err := queue.List(context.Background(), c.queue, tq.Page{})
+			require.NoError(t, err)
+			require.Equal(t, len(c.popped), len(ts))
+
+			for i, expected := range c.popped {
+				task, err := queue.Pop(context.Background(), c.queue)
+				require.NoError(t, err)
+				require.Equal(t, expected.Data, task.Data)
+				require.Equal(t, expected.Data, ts[i].Data)
+				require.Equal(t, c.queue, task.Queue)
+			}
+		})
+	}
+}
+
+func TestList_Conformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		return redis.NewTaskQueue(client, limit, opts...)
+	})
+}
+
+func TestList_Namespace(t *testing.T) {
+	namespace := fmt.Sprintf("billing-%d", time.Now().UnixNano())
+	billing := redis.NewTaskQueue(client, 1, tq.WithNamespace(namespace))
+	shipping := redis.NewTaskQueue(client, 1, tq.WithNamespace(namespace+"-shipping"))
+
+	_, err := billing.Push(context.Background(), "bg-queue", tq.Message{Data: []byte("invoice")})
+	require.NoError(t, err)
+	_, err = shipping.Push(context.Background(), "bg-queue", tq.Message{Priority: 1, Data: []byte("parcel")})
+	require.NoError(t, err, "the limit of a namespace does not count the tasks of another")
+	require.NoError(t, billing.Pause(context.Background(), "bg-queue"))
+
+	task, err := shipping.Pop(context.Background(), "bg-queue")
+	require.NoError(t, err, "pausing a queue does not pause it in another namespace")
+	require.Equal(t, []byte("parcel"), task.Data)
+
+	keys, err := client.Keys(context.Background(), "*"+namespace+"*").Result()
+	require.NoError(t, err)
+	require.NotEmpty(t, keys)
+	for _, key := range keys {
+		require.Regexp(t, `^\{`+namespace+`(-shipping)?\}:`, key, "every key carries the namespace as a hash tag")
+	}
+}
+
+func TestList_QueueName(t *testing.T) {
+	queue := redis.NewTaskQueue(client, 10)
+
+	for _, name := range []string{"emails:stats", "emails:priorities", "emails:1", "{emails}", "paused-queues", "queue-names"} {
+		_, err := queue.Push(context.Background(), name, tq.Message{Data: []byte("a")})
+		require.Equal(t, errors.ErrInvalidQueueName, err, name)
+		_, err = queue.Pop(context.Background(), name)
+		require.Equal(t, errors.ErrInvalidQueueName, err, name)
+		_, err = queue.Move(context.Background(), "emails", name, tq.Filter{})
+		require.Equal(t, errors.ErrInvalidQueueName, err, name)
+	}
+}
+
+func TestList_NamespaceConformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		return redis.NewTaskQueue(client, limit, append(opts, tq.WithNamespace("conformance"))...)
+	})
+}
+
+func withoutEnqueued(msgs ...tq.Message) []tq.Message {
+	res := make([]tq.Message, len(msgs))
+	for i := range msgs {
+		res[i] = msgs[i]
+		res[i].ID = ""
+		res[i].Enqueued = time.Time{}
+	}
+
+	return res
 }
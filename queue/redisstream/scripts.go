@@ -0,0 +1,101 @@
+package redisstream
+
+import "github.com/go-redis/redis/v8"
+
+// pushScript adds an entry unless the queue is full, deleting the oldest
+// entry not delivered yet of the lowest priority first when allowed to. The
+// length of a stream is counted like levels does: its entries minus those
+// pending in the group. It returns the index of the entry or -1 when the
+// queue is full.
+//
+// Every key the script touches is declared in KEYS, as Redis Cluster
+// requires: the stream of every priority comes last, in the order of the
+// JSON array of priorities, highest first, passed as the first argument. The
+// script fails with STALE when the queue uses a priority that was not
+// passed, and is run again by Stream.push.
+//
+// KEYS: priorities, stats, queue names, streams
+// ARGV: priorities, queue, priority, limit, drop oldest, group, type,
+// headers, data
+var pushScript = redis.NewScript(`
+local name, priority = ARGV[2], tonumber(ARGV[3])
+local limit, drop, group = tonumber(ARGV[4]), ARGV[5] == '1', ARGV[6]
+
+local levels, streams = cjson.decode(ARGV[1]), {}
+for i, level in ipairs(levels) do
+	streams[level] = KEYS[3 + i]
+end
+for _, member in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if not streams[tonumber(member)] then
+		return redis.error_reply('STALE the priorities of the queue changed')
+	end
+end
+
+-- length returns the entries of a stream not delivered yet and the ID of
+-- the last entry delivered to the group, if any.
+local function length(stream)
+	local n = redis.call('XLEN', stream)
+	local groups = redis.pcall('XINFO', 'GROUPS', stream)
+	if type(groups) ~= 'table' or groups.err then
+		return n, nil
+	end
+	for _, g in ipairs(groups) do
+		local info = {}
+		for i = 1, #g, 2 do
+			info[g[i]] = g[i + 1]
+		end
+		if info['name'] == group then
+			return n - info['pending'], info['last-delivered-id']
+		end
+	end
+	return n, nil
+end
+
+local total, index, lowest, delivered = 0, 0, nil, nil
+for _, level in ipairs(levels) do
+	local n, last = length(streams[level])
+	total = total + n
+	if level >= priority then
+		index = index + n
+	end
+	if n > 0 then
+		lowest, delivered = level, last
+	end
+end
+
+if limit > 0 and total >= limit then
+	if not drop or lowest == nil then
+		return -1
+	end
+
+	local entries = redis.call('XRANGE', streams[lowest], delivered or '-', '+', 'COUNT', 2)
+	for _, entry in ipairs(entries) do
+		if entry[1] ~= delivered then
+			redis.call('XDEL', streams[lowest], entry[1])
+			break
+		end
+	end
+	if lowest >= priority then
+		index = index - 1
+	end
+end
+
+local values = {'data', ARGV[9]}
+if ARGV[7] ~= '' then
+	table.insert(values, 'type')
+	table.insert(values, ARGV[7])
+end
+if ARGV[8] ~= '' then
+	table.insert(values, 'headers')
+	table.insert(values, ARGV[8])
+end
+
+if priority ~= 0 then
+	redis.call('ZADD', KEYS[1], priority, priority)
+end
+redis.call('XADD', streams[priority], '*', unpack(values))
+redis.call('SADD', KEYS[3], name)
+redis.call('HINCRBY', KEYS[2], 'enqueued', 1)
+
+return index
+`)
@@ -0,0 +1,1015 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultGroup      = "dispatcher"
+	DefaultClaimAfter = time.Minute
+
+	popTimeout   = time.Second
+	pushInterval = 100 * time.Millisecond
+	txRetries    = 10
+	listChunk    = 100
+)
+
+var (
+	_ tq.TaskQueue = (*Stream)(nil)
+	_ tq.Acker     = (*Stream)(nil)
+)
+
+// Consumer identifies a dispatcher process within the consumer group that
+// shares the queues.
+type Consumer struct {
+	// Group is shared by every dispatcher consuming the queues. Defaults to
+	// DefaultGroup.
+	Group string
+	// Name has to be unique within the group. Defaults to the host name and
+	// the process ID.
+	Name string
+	// ClaimAfter is how long a popped task may stay unacknowledged before
+	// the next pop of any consumer of the group claims it. Defaults to
+	// DefaultClaimAfter.
+	ClaimAfter time.Duration
+}
+
+// Stream stores every priority of a queue in its own redis stream, read by
+// a consumer group. Popped tasks stay in the pending entry list of their
+// consumer until they are acknowledged and are then deleted from the
+// stream, so the tasks of a queue are the entries the group has not been
+// delivered yet. Streams only append, so every queue is FIFO and LIFO
+// orders are ignored.
+type Stream struct {
+	client   redis.UniversalClient
+	keys     keyspace
+	consumer Consumer
+	limit    int64
+	config   tq.Config
+}
+
+// Pending is a task popped by a consumer and not acknowledged yet.
+type Pending struct {
+	ID         string
+	Priority   int
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// NewTaskQueue accepts any client of a standalone, Sentinel or Cluster
+// deployment. Cluster deployments need a namespace, see keyspace.
+func NewTaskQueue(client redis.UniversalClient, consumer Consumer, limit int64, opts ...tq.Option) tq.TaskQueue {
+	if consumer.Group == "" {
+		consumer.Group = DefaultGroup
+	}
+	if consumer.Name == "" {
+		host, _ := os.Hostname()
+		consumer.Name = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if consumer.ClaimAfter == 0 {
+		consumer.ClaimAfter = DefaultClaimAfter
+	}
+
+	config := tq.NewConfig(opts...)
+
+	return &Stream{client, keyspace(config.Namespace()), consumer, limit, config}
+}
+
+// cmdable is implemented by clients and transactions.
+type cmdable interface {
+	redis.Cmdable
+	Process(ctx context.Context, cmd redis.Cmder) error
+}
+
+// level is the part of a queue stored in the stream of one priority.
+type level struct {
+	priority int
+	// length counts the entries not delivered to the group yet.
+	length int64
+	// start is the first ID of the entries not delivered yet.
+	start string
+}
+
+// Push polls a full queue with the Block overflow policy until it has room.
+func (q *Stream) Push(ctx context.Context, queue string, ts tq.Message) (int, error) {
+	for {
+		index, err := q.push(ctx, queue, ts, true)
+		if err != nil && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != tq.ErrFullQueue || q.config.Overflow(queue) != tq.Block {
+			return index, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(pushInterval):
+		}
+	}
+}
+
+func (q *Stream) Requeue(ctx context.Context, queue string, ts tq.Message) error {
+	_, err := q.push(ctx, queue, ts, false)
+	return err
+}
+
+// push runs pushScript, so that concurrent producers can not exceed the
+// limit between checking the length of the queue and adding to it. The
+// queue is taken as unlimited unless bounded.
+func (q *Stream) push(ctx context.Context, queue string, ts tq.Message, bounded bool) (int, error) {
+	var headers []byte
+	if len(ts.Headers) > 0 {
+		headers, _ = json.Marshal(ts.Headers)
+	}
+	drop := 0
+	if q.config.Overflow(queue) == tq.DropOldest {
+		drop = 1
+	}
+	var limit int64
+	if bounded {
+		limit = q.config.Limit(queue, q.limit)
+	}
+
+	var index int64
+	var err error
+	for i := 0; i < txRetries; i++ {
+		var priorities []int
+		priorities, err = q.priorities(ctx, q.client, queue)
+		if err != nil {
+			return 0, tq.ErrCreateEntity
+		}
+		if !containsPriority(priorities, ts.Priority) {
+			priorities = append(priorities, ts.Priority)
+			sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+		}
+
+		keys := []string{q.keys.priorities(queue), q.keys.stats(queue), q.keys.queues()}
+		for _, priority := range priorities {
+			keys = append(keys, q.keys.key(queue, priority))
+		}
+		encoded, _ := json.Marshal(priorities)
+
+		index, err = pushScript.Run(ctx, q.client, keys, string(encoded), queue, ts.Priority, limit,
+			drop, q.consumer.Group, ts.Type, headers, ts.Data).Int64()
+		if err == nil || !strings.HasPrefix(err.Error(), "STALE") {
+			break
+		}
+	}
+	if err != nil {
+		return 0, tq.ErrCreateEntity
+	}
+	if index < 0 {
+		return 0, tq.ErrFullQueue
+	}
+
+	return int(index), nil
+}
+
+func (q *Stream) Pop(ctx context.Context, queue string) (tq.Message, error) {
+	if paused, _ := q.Paused(ctx, queue); paused {
+		return tq.Message{}, tq.ErrQueuePaused
+	}
+
+	priorities, err := q.priorities(ctx, q.client, queue)
+	if err != nil {
+		return tq.Message{}, tq.ErrRetrieveEntity
+	}
+
+	for _, priority := range priorities {
+		tasks, err := q.read(ctx, queue, priority, 1)
+		if err != nil {
+			return tq.Message{}, tq.ErrRetrieveEntity
+		}
+		if len(tasks) > 0 {
+			return tasks[0], nil
+		}
+	}
+
+	return tq.Message{}, tq.ErrEmptyQueue
+}
+
+// PopN reads the priorities in order until it has n tasks, each of them
+// taking a single claim and a single read.
+func (q *Stream) PopN(ctx context.Context, queue string, n int) ([]tq.Message, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if paused, _ := q.Paused(ctx, queue); paused {
+		return nil, tq.ErrQueuePaused
+	}
+
+	priorities, err := q.priorities(ctx, q.client, queue)
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	var popped []tq.Message
+	for _, priority := range priorities {
+		tasks, err := q.read(ctx, queue, priority, n-len(popped))
+		if err != nil {
+			// the tasks read so far are pending and claimed again later.
+			return nil, tq.ErrRetrieveEntity
+		}
+		popped = append(popped, tasks...)
+		if len(popped) == n {
+			break
+		}
+	}
+	if len(popped) == 0 {
+		return nil, tq.ErrEmptyQueue
+	}
+
+	return popped, nil
+}
+
+// PopFilter deletes the matching task from its stream instead of reading it
+// through the group, so it is never pending and needs no acknowledgement.
+func (q *Stream) PopFilter(ctx context.Context, queue string, filter tq.Filter) (tq.Message, error) {
+	if paused, _ := q.Paused(ctx, queue); paused {
+		return tq.Message{}, tq.ErrQueuePaused
+	}
+
+	var popped []tq.Message
+	err := q.transaction(ctx, func(tx *redis.Tx) error {
+		entries, err := q.snapshot(ctx, tx, queue)
+		if err != nil {
+			return err
+		}
+
+		popped = match(entries, filter)
+		if len(popped) == 0 {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XDel(ctx, q.keys.key(queue, popped[0].Priority), popped[0].ID)
+			pipe.HIncrBy(ctx, q.keys.stats(queue), "dequeued", 1)
+			return nil
+		})
+		return err
+	}, q.keys.priorities(queue))
+	if err != nil {
+		return tq.Message{}, tq.ErrRetrieveEntity
+	}
+	if len(popped) == 0 {
+		return tq.Message{}, tq.ErrEmptyQueue
+	}
+
+	return popped[0], nil
+}
+
+// BlockingPop reads the queues in order and, when they are all empty, waits
+// for an entry to be added to any of their streams before reading again.
+// The wait is cut into short rounds so that priorities first used, queues
+// paused or resumed and tasks left pending by dead consumers are picked up,
+// and ctx is checked between them: a round cancelled halfway could leave a
+// task pending until it is claimed.
+func (q *Stream) BlockingPop(ctx context.Context, queues ...string) (tq.Message, error) {
+	round := context.Background()
+	for {
+		if err := ctx.Err(); err != nil {
+			return tq.Message{}, err
+		}
+
+		paused, err := q.client.SMembers(round, q.keys.paused()).Result()
+		if err != nil {
+			return tq.Message{}, tq.ErrRetrieveEntity
+		}
+
+		var keys []string
+		for _, queue := range queues {
+			if contains(paused, queue) {
+				continue
+			}
+
+			priorities, err := q.priorities(round, q.client, queue)
+			if err != nil {
+				return tq.Message{}, tq.ErrRetrieveEntity
+			}
+
+			for _, priority := range priorities {
+				tasks, err := q.read(round, queue, priority, 1)
+				if err != nil {
+					return tq.Message{}, tq.ErrRetrieveEntity
+				}
+				if len(tasks) > 0 {
+					return tasks[0], nil
+				}
+				keys = append(keys, q.keys.key(queue, priority))
+			}
+		}
+
+		if len(keys) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(popTimeout):
+			}
+			continue
+		}
+
+		streams := keys
+		for range keys {
+			streams = append(streams, "$")
+		}
+		err = q.client.XRead(round, &redis.XReadArgs{Streams: streams, Count: 1, Block: popTimeout}).Err()
+		if err != nil && err != redis.Nil {
+			return tq.Message{}, tq.ErrRetrieveEntity
+		}
+	}
+}
+
+// Ack removes a popped task from the pending entry list of the consumer and
+// from its stream.
+func (q *Stream) Ack(ctx context.Context, ts tq.Message) error {
+	_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, q.keys.key(ts.Queue, ts.Priority), q.consumer.Group, ts.ID)
+		pipe.XDel(ctx, q.keys.key(ts.Queue, ts.Priority), ts.ID)
+		return nil
+	})
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+
+	return nil
+}
+
+// Pending lists the tasks of the queue popped by any consumer of the group
+// and not acknowledged yet.
+func (q *Stream) Pending(ctx context.Context, queue string) ([]Pending, error) {
+	priorities, err := q.priorities(ctx, q.client, queue)
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	var pending []Pending
+	for _, priority := range priorities {
+		entries, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: q.keys.key(queue, priority),
+			Group:  q.consumer.Group,
+			Start:  "-",
+			End:    "+",
+			Count:  1 << 20,
+		}).Result()
+		if err == redis.Nil || missing(err) {
+			continue
+		}
+		if err != nil {
+			return nil, tq.ErrRetrieveEntity
+		}
+
+		for _, entry := range entries {
+			pending = append(pending, Pending{
+				ID:         entry.ID,
+				Priority:   priority,
+				Consumer:   entry.Consumer,
+				Idle:       entry.Idle,
+				Deliveries: entry.RetryCount,
+			})
+		}
+	}
+
+	return pending, nil
+}
+
+func (q *Stream) Get(ctx context.Context, queue string, index int) (tq.Message, error) {
+	priority, id, err := q.locate(ctx, queue, index)
+	if err != nil {
+		return tq.Message{}, err
+	}
+
+	entries, err := q.client.XRangeN(ctx, q.keys.key(queue, priority), id, id, 1).Result()
+	if err != nil || len(entries) == 0 {
+		return tq.Message{}, tq.ErrEntityNotFound
+	}
+
+	return decode(queue, priority, entries[0]), nil
+}
+
+// List reads the streams listChunk entries at a time and stops once the
+// page is full.
+func (q *Stream) List(ctx context.Context, queue string, page tq.Page) ([]tq.Message, error) {
+	levels, err := q.levels(ctx, q.client, queue)
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+
+	var ts []tq.Message
+	skipped := 0
+	for _, l := range levels {
+		if page.Unfiltered() && skipped+int(l.length) <= page.Offset {
+			// the whole stream is before the page.
+			skipped += int(l.length)
+			continue
+		}
+
+		start := l.start
+		for l.length > 0 && !page.Full(len(ts)) {
+			entries, err := q.client.XRangeN(ctx, q.keys.key(queue, l.priority), start, "+", listChunk).Result()
+			if err != nil {
+				return nil, tq.ErrRetrieveEntity
+			}
+
+			for _, entry := range entries {
+				msg := decode(queue, l.priority, entry)
+				if page.Full(len(ts)) || !page.Match(msg) {
+					continue
+				}
+				if skipped < page.Offset {
+					skipped++
+					continue
+				}
+				ts = append(ts, msg)
+			}
+			if len(entries) < listChunk {
+				break
+			}
+			start = after(entries[len(entries)-1].ID)
+		}
+	}
+	if len(ts) == 0 {
+		return nil, tq.ErrEmptyQueue
+	}
+
+	return ts, nil
+}
+
+func (q *Stream) Remove(ctx context.Context, queue string, index int) error {
+	priority, id, err := q.locate(ctx, queue, index)
+	if err != nil {
+		return err
+	}
+
+	removed, err := q.client.XDel(ctx, q.keys.key(queue, priority), id).Result()
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+	if removed == 0 {
+		return tq.ErrEntityNotFound
+	}
+
+	return nil
+}
+
+// RemoveID removes the entry with the given ID from whichever stream of the
+// queue holds it, unless it was delivered already.
+func (q *Stream) RemoveID(ctx context.Context, queue string, id string) error {
+	var removed bool
+	err := q.transaction(ctx, func(tx *redis.Tx) error {
+		removed = false
+		entries, err := q.snapshot(ctx, tx, queue)
+		if err != nil {
+			return err
+		}
+
+		for _, ts := range entries {
+			if ts.ID != id {
+				continue
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.XDel(ctx, q.keys.key(queue, ts.Priority), ts.ID)
+				return nil
+			})
+			removed = err == nil
+			return err
+		}
+		return nil
+	}, q.keys.priorities(queue))
+	if err != nil {
+		return tq.ErrRemoveEntity
+	}
+	if !removed {
+		return tq.ErrEntityNotFound
+	}
+
+	return nil
+}
+
+func (q *Stream) Pause(ctx context.Context, queue string) error {
+	if err := q.client.SAdd(ctx, q.keys.paused(), queue).Err(); err != nil {
+		return tq.ErrCreateEntity
+	}
+
+	return nil
+}
+
+func (q *Stream) Resume(ctx context.Context, queue string) error {
+	if err := q.client.SRem(ctx, q.keys.paused(), queue).Err(); err != nil {
+		return tq.ErrRemoveEntity
+	}
+
+	return nil
+}
+
+func (q *Stream) Paused(ctx context.Context, queue string) (bool, error) {
+	paused, err := q.client.SIsMember(ctx, q.keys.paused(), queue).Result()
+	if err != nil {
+		return false, tq.ErrRetrieveEntity
+	}
+
+	return paused, nil
+}
+
+func (q *Stream) Delete(ctx context.Context, queue string, filter tq.Filter) ([]tq.Message, error) {
+	var removed []tq.Message
+	err := q.transaction(ctx, func(tx *redis.Tx) error {
+		entries, err := q.snapshot(ctx, tx, queue)
+		if err != nil {
+			return err
+		}
+
+		removed = match(entries, filter)
+		if len(removed) == 0 {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, ts := range removed {
+				pipe.XDel(ctx, q.keys.key(queue, ts.Priority), ts.ID)
+			}
+			return nil
+		})
+		return err
+	}, q.keys.priorities(queue))
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return removed, nil
+}
+
+func (q *Stream) Move(ctx context.Context, from, to string, filter tq.Filter) ([]tq.Message, error) {
+	if from == to {
+		return nil, nil
+	}
+
+	var moved []tq.Message
+	err := q.transaction(ctx, func(tx *redis.Tx) error {
+		entries, err := q.snapshot(ctx, tx, from)
+		if err != nil {
+			return err
+		}
+		target, err := q.snapshot(ctx, tx, to)
+		if err != nil {
+			return err
+		}
+
+		moved = match(entries, filter)
+		if len(moved) == 0 {
+			return nil
+		}
+		if q.config.Full(to, len(target), len(moved), q.limit) {
+			return tq.ErrFullQueue
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, ts := range moved {
+				pipe.XDel(ctx, q.keys.key(from, ts.Priority), ts.ID)
+				q.add(ctx, pipe, to, ts)
+			}
+			return nil
+		})
+		return err
+	}, q.keys.priorities(from), q.keys.priorities(to))
+	if err == tq.ErrFullQueue {
+		return nil, err
+	}
+	if err != nil {
+		return nil, tq.ErrRemoveEntity
+	}
+
+	return moved, nil
+}
+
+func (q *Stream) ListQueues(ctx context.Context) ([]string, error) {
+	queues, err := q.client.SMembers(ctx, q.keys.queues()).Result()
+	if err != nil {
+		return nil, tq.ErrRetrieveEntity
+	}
+	sort.Strings(queues)
+
+	return queues, nil
+}
+
+// QueueStats takes the enqueue time of the oldest task from the ID of the
+// first entry not delivered yet of every priority.
+func (q *Stream) QueueStats(ctx context.Context, queue string) (tq.Stats, error) {
+	levels, err := q.levels(ctx, q.client, queue)
+	if err != nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+
+	stats := tq.Stats{Queue: queue, At: time.Now()}
+	for _, l := range levels {
+		if l.length == 0 {
+			continue
+		}
+		stats.Length += int(l.length)
+
+		entries, err := q.client.XRangeN(ctx, q.keys.key(queue, l.priority), l.start, "+", 1).Result()
+		if err != nil {
+			return tq.Stats{}, tq.ErrRetrieveEntity
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		enqueued := enqueuedAt(entries[0].ID)
+		if stats.Oldest.IsZero() || enqueued.Before(stats.Oldest) {
+			stats.Oldest = enqueued
+		}
+	}
+
+	paused, err := q.Paused(ctx, queue)
+	if err != nil {
+		return tq.Stats{}, err
+	}
+	counters, err := q.client.HGetAll(ctx, q.keys.stats(queue)).Result()
+	if err != nil {
+		return tq.Stats{}, tq.ErrRetrieveEntity
+	}
+	stats.Paused = paused
+	stats.Enqueued, _ = strconv.ParseInt(counters["enqueued"], 10, 64)
+	stats.Dequeued, _ = strconv.ParseInt(counters["dequeued"], 10, 64)
+
+	return stats, nil
+}
+
+// read pops up to n tasks of one priority, claiming tasks left pending for
+// too long by other consumers before reading new ones.
+func (q *Stream) read(ctx context.Context, queue string, priority, n int) ([]tq.Message, error) {
+	tasks, err := q.claim(ctx, queue, priority, n)
+	if missing(err) {
+		// the stream may have been created by a move, which does not
+		// create the group.
+		if q.client.XGroupCreate(ctx, q.keys.key(queue, priority), q.consumer.Group, "0").Err() != nil {
+			return nil, nil
+		}
+		tasks, err = q.claim(ctx, queue, priority, n)
+	}
+	if err != nil || len(tasks) == n {
+		return tasks, err
+	}
+
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.consumer.Group,
+		Consumer: q.consumer.Name,
+		Streams:  []string{q.keys.key(queue, priority), ">"},
+		Count:    int64(n - len(tasks)),
+		Block:    -1,
+	}).Result()
+	if err == redis.Nil {
+		return tasks, nil
+	}
+	if err != nil {
+		return tasks, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return tasks, nil
+	}
+
+	q.client.HIncrBy(ctx, q.keys.stats(queue), "dequeued", int64(len(streams[0].Messages)))
+	for _, entry := range streams[0].Messages {
+		tasks = append(tasks, decode(queue, priority, entry))
+	}
+	return tasks, nil
+}
+
+func (q *Stream) claim(ctx context.Context, queue string, priority, n int) ([]tq.Message, error) {
+	reply, err := do(ctx, q.client, "XAUTOCLAIM", q.keys.key(queue, priority), q.consumer.Group, q.consumer.Name,
+		q.consumer.ClaimAfter.Milliseconds(), "0-0", "COUNT", n).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// the reply holds the next cursor and the claimed entries, which are
+	// nil when they were deleted while pending.
+	parts, _ := reply.([]interface{})
+	if len(parts) < 2 {
+		return nil, nil
+	}
+	claimed, _ := parts[1].([]interface{})
+	var tasks []tq.Message
+	for _, c := range claimed {
+		entry, _ := c.([]interface{})
+		if len(entry) < 2 {
+			continue
+		}
+
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]interface{})
+		values := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := fields[i].(string)
+			values[name] = fields[i+1]
+		}
+
+		tasks = append(tasks, decode(queue, priority, redis.XMessage{ID: id, Values: values}))
+	}
+
+	return tasks, nil
+}
+
+// priorities returns the priorities in use by the queue, highest first.
+func (q *Stream) priorities(ctx context.Context, c redis.Cmdable, queue string) ([]int, error) {
+	members, err := c.ZRange(ctx, q.keys.priorities(queue), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := []int{0}
+	for _, member := range members {
+		priority, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, err
+		}
+		if priority != 0 {
+			priorities = append(priorities, priority)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	return priorities, nil
+}
+
+// levels returns the priorities in use by the queue, highest first, with
+// the entries of their streams the group has not been delivered yet. The
+// commands are not pipelined since a pipeline of a transaction would end
+// it.
+func (q *Stream) levels(ctx context.Context, c cmdable, queue string) ([]level, error) {
+	priorities, err := q.priorities(ctx, c, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	levels := make([]level, len(priorities))
+	for i, priority := range priorities {
+		length, err := c.XLen(ctx, q.keys.key(queue, priority)).Result()
+		if err != nil {
+			return nil, err
+		}
+		levels[i] = level{priority: priority, length: length, start: "-"}
+
+		groups, err := do(ctx, c, "XINFO", "GROUPS", q.keys.key(queue, priority)).Result()
+		if missing(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if pending, delivered, ok := groupInfo(groups, q.consumer.Group); ok {
+			levels[i].length -= pending
+			levels[i].start = after(delivered)
+		}
+	}
+
+	return levels, nil
+}
+
+// snapshot watches every stream of the queue and returns the tasks not
+// delivered yet, in pop order.
+func (q *Stream) snapshot(ctx context.Context, tx *redis.Tx, queue string) ([]tq.Message, error) {
+	priorities, err := q.priorities(ctx, tx, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(priorities))
+	for i, priority := range priorities {
+		keys[i] = q.keys.key(queue, priority)
+	}
+	if err := tx.Watch(ctx, keys...).Err(); err != nil {
+		return nil, err
+	}
+
+	levels, err := q.levels(ctx, tx, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tq.Message
+	for _, l := range levels {
+		if l.length == 0 {
+			continue
+		}
+
+		stream, err := tx.XRange(ctx, q.keys.key(queue, l.priority), l.start, "+").Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range stream {
+			entries = append(entries, decode(queue, l.priority, entry))
+		}
+	}
+
+	return entries, nil
+}
+
+// locate translates an index in pop order to a priority and an entry ID.
+func (q *Stream) locate(ctx context.Context, queue string, index int) (int, string, error) {
+	levels, err := q.levels(ctx, q.client, queue)
+	if err != nil {
+		return 0, "", tq.ErrRetrieveEntity
+	}
+
+	offset := int64(index)
+	for _, l := range levels {
+		if offset >= 0 && offset < l.length {
+			entries, err := q.client.XRangeN(ctx, q.keys.key(queue, l.priority), l.start, "+", offset+1).Result()
+			if err != nil || int64(len(entries)) <= offset {
+				return 0, "", tq.ErrEntityNotFound
+			}
+
+			return l.priority, entries[offset].ID, nil
+		}
+		offset -= l.length
+	}
+
+	return 0, "", tq.ErrEntityNotFound
+}
+
+// transaction runs fn watching the keys, retrying when a watched key
+// changes before the transaction commits.
+func (q *Stream) transaction(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < txRetries; i++ {
+		err := q.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+func (q *Stream) add(ctx context.Context, pipe redis.Pipeliner, queue string, ts tq.Message) {
+	values := map[string]interface{}{"data": ts.Data}
+	if ts.Type != "" {
+		values["type"] = ts.Type
+	}
+	if len(ts.Headers) > 0 {
+		headers, _ := json.Marshal(ts.Headers)
+		values["headers"] = headers
+	}
+
+	if ts.Priority != 0 {
+		pipe.ZAdd(ctx, q.keys.priorities(queue), &redis.Z{Score: float64(ts.Priority), Member: ts.Priority})
+	}
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: q.keys.key(queue, ts.Priority), ID: "*", Values: values})
+	pipe.SAdd(ctx, q.keys.queues(), queue)
+	pipe.HIncrBy(ctx, q.keys.stats(queue), "enqueued", 1)
+}
+
+func decode(queue string, priority int, entry redis.XMessage) tq.Message {
+	ts := tq.Message{ID: entry.ID, Queue: queue, Priority: priority, Enqueued: enqueuedAt(entry.ID), Data: []byte{}}
+	if data, ok := entry.Values["data"].(string); ok {
+		ts.Data = []byte(data)
+	}
+	if typ, ok := entry.Values["type"].(string); ok {
+		ts.Type = typ
+	}
+	if headers, ok := entry.Values["headers"].(string); ok {
+		json.Unmarshal([]byte(headers), &ts.Headers)
+	}
+
+	return ts
+}
+
+func match(entries []tq.Message, filter tq.Filter) []tq.Message {
+	var matched []tq.Message
+	for _, ts := range entries {
+		if filter.Match(ts) {
+			matched = append(matched, ts)
+		}
+	}
+
+	return matched
+}
+
+// groupInfo finds the group in a reply of XINFO GROUPS.
+func groupInfo(reply interface{}, group string) (int64, string, bool) {
+	groups, _ := reply.([]interface{})
+	for _, g := range groups {
+		fields, _ := g.([]interface{})
+		info := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := fields[i].(string)
+			info[name] = fields[i+1]
+		}
+		if info["name"] != group {
+			continue
+		}
+
+		pending, _ := info["pending"].(int64)
+		delivered, _ := info["last-delivered-id"].(string)
+		return pending, delivered, true
+	}
+
+	return 0, "", false
+}
+
+func containsPriority(priorities []int, priority int) bool {
+	for _, p := range priorities {
+		if p == priority {
+			return true
+		}
+	}
+
+	return false
+}
+
+// after returns the smallest entry ID greater than id.
+func after(id string) string {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return "-"
+	}
+	next, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "-"
+	}
+
+	return fmt.Sprintf("%s-%d", ms, next+1)
+}
+
+// enqueuedAt reads the time an entry was added from the milliseconds
+// leading its ID.
+func enqueuedAt(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(millis)
+}
+
+// missing reports whether err comes from a stream or a group that does not
+// exist yet.
+func missing(err error) bool {
+	return err != nil && (strings.HasPrefix(err.Error(), "NOGROUP") || strings.Contains(err.Error(), "no such key"))
+}
+
+func contains(queues []string, queue string) bool {
+	for i := range queues {
+		if queues[i] == queue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// do sends a command go-redis has no method for.
+func do(ctx context.Context, c cmdable, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx, args...)
+	c.Process(ctx, cmd)
+
+	return cmd
+}
+
+// keyspace names the keys of a namespace. Without a namespace the keys are
+// named as by earlier versions. Otherwise every key starts with the
+// namespace as a hash tag, so the keys of a namespace share a Cluster hash
+// slot and reads of several queues, moves and scripts keep working;
+// separate namespaces spread the load over the nodes.
+type keyspace string
+
+func (ks keyspace) key(queue string, priority int) string {
+	return fmt.Sprintf("%s%s:stream:%d", ks.prefix(), queue, priority)
+}
+
+func (ks keyspace) stats(queue string) string {
+	return ks.prefix() + queue + ":stream:stats"
+}
+
+func (ks keyspace) priorities(queue string) string {
+	return ks.prefix() + queue + ":stream:priorities"
+}
+
+func (ks keyspace) paused() string {
+	return ks.prefix() + "paused-streams"
+}
+
+func (ks keyspace) queues() string {
+	return ks.prefix() + "stream-names"
+}
+
+func (ks keyspace) prefix() string {
+	if ks == "" {
+		return ""
+	}
+	return "{" + string(ks) + "}:"
+}
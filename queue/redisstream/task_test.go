@@ -0,0 +1,156 @@
+package redisstream_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ZutrixPog/dispatcher"
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/queuetest"
+	"github.com/ZutrixPog/dispatcher/queue/redisstream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream_Conformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		return redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "conformance"}, limit, opts...)
+	}, queuetest.LIFO)
+}
+
+func TestStream_Namespace(t *testing.T) {
+	namespace := fmt.Sprintf("billing-%d", time.Now().UnixNano())
+	billing := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "worker"}, 1, tq.WithNamespace(namespace))
+	shipping := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "worker"}, 1, tq.WithNamespace(namespace+"-shipping"))
+
+	_, err := billing.Push(context.Background(), "bg-queue", tq.Message{Data: []byte("invoice")})
+	require.NoError(t, err)
+	_, err = shipping.Push(context.Background(), "bg-queue", tq.Message{Data: []byte("parcel")})
+	require.NoError(t, err, "the limit of a namespace does not count the tasks of another")
+	require.NoError(t, billing.Pause(context.Background(), "bg-queue"))
+
+	task, err := shipping.Pop(context.Background(), "bg-queue")
+	require.NoError(t, err, "pausing a queue does not pause it in another namespace")
+	require.Equal(t, []byte("parcel"), task.Data)
+
+	keys, err := client.Keys(context.Background(), "*"+namespace+"*").Result()
+	require.NoError(t, err)
+	require.NotEmpty(t, keys)
+	for _, key := range keys {
+		require.Regexp(t, `^\{`+namespace+`(-shipping)?\}:`, key, "every key carries the namespace as a hash tag")
+	}
+}
+
+func TestStream_NamespaceConformance(t *testing.T) {
+	queuetest.RunConformance(t, func(t *testing.T, limit int64, opts ...tq.Option) tq.TaskQueue {
+		return redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "conformance"}, limit, append(opts, tq.WithNamespace("conformance"))...)
+	}, queuetest.LIFO)
+}
+
+func TestStream_Ack(t *testing.T) {
+	queue := fmt.Sprintf("ack-%d", time.Now().UnixNano())
+	q := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "worker"}, 10).(*redisstream.Stream)
+
+	_, err := q.Push(context.Background(), queue, tq.Message{Data: []byte("a")})
+	require.NoError(t, err)
+
+	task, err := q.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.NotEmpty(t, task.ID)
+
+	pending, err := q.Pending(context.Background(), queue)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, task.ID, pending[0].ID)
+	require.Equal(t, "worker", pending[0].Consumer)
+
+	stats, err := q.QueueStats(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Length, "pending tasks are not part of the queue")
+
+	require.NoError(t, q.Ack(context.Background(), task))
+	pending, err = q.Pending(context.Background(), queue)
+	require.NoError(t, err)
+	require.Empty(t, pending, "acknowledged tasks leave the pending entry list")
+}
+
+func TestStream_Claim(t *testing.T) {
+	queue := fmt.Sprintf("claim-%d", time.Now().UnixNano())
+	crashed := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "crashed", ClaimAfter: 50 * time.Millisecond}, 10)
+	survivor := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "survivor", ClaimAfter: 50 * time.Millisecond}, 10)
+
+	for _, data := range []string{"a", "b"} {
+		_, err := crashed.Push(context.Background(), queue, tq.Message{Data: []byte(data)})
+		require.NoError(t, err)
+	}
+
+	lost, err := crashed.Pop(context.Background(), queue)
+	require.NoError(t, err)
+
+	task, err := survivor.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(task.Data), "fresh pending tasks are not claimed")
+	require.NoError(t, survivor.(tq.Acker).Ack(context.Background(), task))
+
+	time.Sleep(100 * time.Millisecond)
+	task, err = survivor.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, lost.ID, task.ID, "stale pending tasks are claimed")
+
+	pending, err := survivor.(*redisstream.Stream).Pending(context.Background(), queue)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, "survivor", pending[0].Consumer)
+	require.Equal(t, int64(2), pending[0].Deliveries)
+}
+
+func TestStream_ConsumerGroup(t *testing.T) {
+	queue := fmt.Sprintf("group-%d", time.Now().UnixNano())
+	first := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "first"}, 10)
+	second := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "second"}, 10)
+
+	for _, data := range []string{"a", "b"} {
+		_, err := first.Push(context.Background(), queue, tq.Message{Data: []byte(data)})
+		require.NoError(t, err)
+	}
+
+	task, err := first.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(task.Data))
+
+	task, err = second.Pop(context.Background(), queue)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(task.Data), "consumers of a group share the queue")
+
+	_, err = first.Pop(context.Background(), queue)
+	require.ErrorIs(t, err, tq.ErrEmptyQueue)
+}
+
+type ackTask struct {
+	Msg string
+}
+
+func (ackTask) Type() string { return "ack" }
+func (ackTask) Retry() int   { return 0 }
+
+func TestStream_DispatchAck(t *testing.T) {
+	queue := fmt.Sprintf("dispatch-ack-%d", time.Now().UnixNano())
+	q := redisstream.NewTaskQueue(client, redisstream.Consumer{Name: "dispatcher"}, 10)
+	manager := dispatcher.New(dispatcher.WithQueue(q))
+	defer manager.Release()
+	manager.Task(&ackTask{}, func(ctx context.Context, task any) error { return nil })
+
+	for _, dispatch := range []func() error{
+		func() error { return manager.Dispatch(context.Background(), queue) },
+		func() error { return manager.DispatchFilter(context.Background(), queue, &ackTask{}) },
+	} {
+		_, err := manager.Spawn(queue, ackTask{Msg: "a"})
+		require.NoError(t, err)
+		require.NoError(t, dispatch())
+
+		pending, err := q.(*redisstream.Stream).Pending(context.Background(), queue)
+		require.NoError(t, err)
+		require.Empty(t, pending, "dispatched tasks are acknowledged")
+	}
+}
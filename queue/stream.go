@@ -0,0 +1,198 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Stream delivers the tasks popped from a TaskQueue until its context is
+// done. At most prefetch tasks are popped ahead of being settled, so a slow
+// consumer leaves the rest of the tasks to other consumers.
+type Stream struct {
+	q          TaskQueue
+	queues     func() []string
+	deliveries chan *Delivery
+	slots      chan struct{}
+	err        error
+}
+
+// Delivery is a task popped by a Stream. Every delivery has to be settled
+// with Ack or Nack, which frees its prefetch slot.
+type Delivery struct {
+	Message
+
+	stream *Stream
+	once   sync.Once
+}
+
+// Consume pops tasks of the queues, checked in the given order, until ctx is
+// done. A prefetch below 1 is taken as 1.
+func Consume(ctx context.Context, q TaskQueue, queues []string, prefetch int) *Stream {
+	return ConsumeFunc(ctx, q, func() []string { return queues }, prefetch)
+}
+
+// ConsumeFunc is Consume with the queues picked again before every pop, to
+// rotate or weight them.
+func ConsumeFunc(ctx context.Context, q TaskQueue, queues func() []string, prefetch int) *Stream {
+	if prefetch < 1 {
+		prefetch = 1
+	}
+
+	s := &Stream{
+		q:          q,
+		queues:     queues,
+		deliveries: make(chan *Delivery, prefetch),
+		slots:      make(chan struct{}, prefetch),
+	}
+	go s.run(ctx)
+
+	return s
+}
+
+// Deliveries returns the channel tasks are delivered on. It is closed once
+// ctx is done or a pop fails; tasks popped but not received by then are
+// pushed back to their queue.
+func (s *Stream) Deliveries() <-chan *Delivery {
+	return s.deliveries
+}
+
+// Err returns the error that ended the stream, the error of ctx when it was
+// cancelled. It is only valid once Deliveries is closed.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+func (s *Stream) run(ctx context.Context) {
+	defer close(s.deliveries)
+	for {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			s.err = s.requeue(ctx.Err())
+			return
+		}
+
+		task, err := s.q.BlockingPop(ctx, s.queues()...)
+		if err != nil {
+			<-s.slots
+			if ctx.Err() != nil {
+				err = s.requeue(ctx.Err())
+			}
+			s.err = err
+			return
+		}
+
+		// a taken slot means there is room in the buffer.
+		for _, task := range append([]Message{task}, s.prefetch()...) {
+			s.deliveries <- &Delivery{Message: task, stream: s}
+		}
+	}
+}
+
+// prefetch fills the free slots, picking the queue of every slot as a
+// blocking pop would, so the queues are weighted per task rather than per
+// pop. The slots of a queue are popped in a single batch, and a queue that
+// falls short or fails is left to the next blocking pop.
+func (s *Stream) prefetch() []Message {
+	free := cap(s.slots) - len(s.slots)
+	exhausted := make(map[string]bool)
+
+	var tasks []Message
+	for len(tasks) < free {
+		var picked []string
+		counts := make(map[string]int)
+		for i := len(tasks); i < free; i++ {
+			for _, queue := range s.queues() {
+				if exhausted[queue] {
+					continue
+				}
+				if counts[queue] == 0 {
+					picked = append(picked, queue)
+				}
+				counts[queue]++
+				break
+			}
+		}
+		if len(picked) == 0 {
+			break
+		}
+
+		for _, queue := range picked {
+			// a batch cancelled halfway could be popped without being
+			// returned.
+			popped, err := s.q.PopN(context.Background(), queue, counts[queue])
+			if err != nil || len(popped) < counts[queue] {
+				exhausted[queue] = true
+			}
+			tasks = append(tasks, popped...)
+		}
+	}
+
+	// only run takes slots, so the free ones are still free.
+	for range tasks {
+		s.slots <- struct{}{}
+	}
+	return tasks
+}
+
+// requeue pushes back the tasks nobody received and joins the errors of the
+// ones that could not be pushed back to err.
+func (s *Stream) requeue(err error) error {
+	errs := []error{err}
+	for {
+		select {
+		case d := <-s.deliveries:
+			// the consumer is gone, so its ctx is of no use here.
+			if nackErr := d.Nack(context.Background()); nackErr != nil {
+				errs = append(errs, nackErr)
+			}
+		default:
+			if len(errs) == 1 {
+				return err
+			}
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// Ack settles a handled task, acknowledging it in backends implementing
+// Acker. It returns ErrSettled when the delivery was already settled.
+func (d *Delivery) Ack(ctx context.Context) error {
+	return d.settle(func() error {
+		if acker, ok := d.stream.q.(Acker); ok {
+			return acker.Ack(ctx, d.Message)
+		}
+
+		return nil
+	})
+}
+
+// Nack settles a task that was not handled by requeueing it, behind the
+// tasks of the same priority and whatever the limit of its queue. A task
+// that can not be requeued stays pending in backends implementing Acker and
+// is lost otherwise.
+func (d *Delivery) Nack(ctx context.Context) error {
+	return d.settle(func() error {
+		task := d.Message
+		task.ID = ""
+		if err := d.stream.q.Requeue(ctx, task.Queue, task); err != nil {
+			return err
+		}
+		if acker, ok := d.stream.q.(Acker); ok {
+			return acker.Ack(ctx, d.Message)
+		}
+
+		return nil
+	})
+}
+
+func (d *Delivery) settle(fn func() error) error {
+	err := ErrSettled
+	d.once.Do(func() {
+		err = fn()
+		<-d.stream.slots
+	})
+
+	return err
+}
@@ -0,0 +1,46 @@
+package queue_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tq "github.com/ZutrixPog/dispatcher/queue"
+	"github.com/ZutrixPog/dispatcher/queue/mem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream_WeightedPrefetch(t *testing.T) {
+	q := mem.NewQueue(10)
+	for _, queue := range []string{"a", "b"} {
+		for i := 0; i < 4; i++ {
+			_, err := q.Push(context.Background(), queue, tq.Message{Data: []byte(queue)})
+			require.NoError(t, err)
+		}
+	}
+
+	// an even weighting, drawn as alternating orders.
+	draws := 0
+	order := func() []string {
+		draws++
+		if draws%2 == 0 {
+			return []string{"b", "a"}
+		}
+		return []string{"a", "b"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := tq.ConsumeFunc(ctx, q, order, 4)
+
+	received := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		select {
+		case delivery := <-stream.Deliveries():
+			received[delivery.Queue]++
+		case <-time.After(5 * time.Second):
+			t.Fatal("no delivery")
+		}
+	}
+	require.Equal(t, map[string]int{"a": 2, "b": 2}, received, "every prefetched task is drawn through the order")
+}
@@ -0,0 +1,207 @@
+package dispatcher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/ZutrixPog/dispatcher/history"
+)
+
+// The outcome of a saga is recorded in the history by a report of type
+// SagaReportType, with the ID of the saga and one of the statuses below. A
+// saga that goes on after being aborted records its outcome again, and the
+// latest report supersedes the earlier ones.
+const (
+	SagaReportType = "saga"
+
+	// SagaCompleted is the status of a saga whose steps all succeeded.
+	SagaCompleted = "completed"
+	// SagaCompensated is the status of a saga that failed and whose
+	// compensations all succeeded.
+	SagaCompensated = "compensated"
+	// SagaAborted is the status of a saga that failed and one of whose
+	// compensations failed too, or whose next task could not be queued.
+	// The failed compensation is moved to the dead letter queue, if any,
+	// and the compensations before it only run if it is moved back and
+	// succeeds.
+	SagaAborted = "aborted"
+)
+
+// Saga is an ordered list of steps where every step may be paired with a
+// compensation. When a step fails permanently, the compensations of the
+// steps that already succeeded are run in reverse order.
+type Saga struct {
+	steps []sagaStep
+}
+
+type sagaStep struct {
+	task         Task
+	compensation Task
+}
+
+// SagaState is the progress of a saga. It travels inside the wrapper of the
+// step that is currently queued, so it is persisted by the queue itself.
+type SagaState struct {
+	ID string `json:"id"`
+	// Codec names the serializer the tasks of the steps were written with.
+	Codec string `json:"codec"`
+	// KeyID names the key the tasks of the steps were encrypted with.
+	KeyID        string     `json:"keyId,omitempty"`
+	Steps        []SagaStep `json:"steps"`
+	Current      int        `json:"current"`
+	Compensating bool       `json:"compensating"`
+}
+
+type SagaStep struct {
+	Type                string `json:"type"`
+	Task                []byte `json:"task"`
+	Retries             int    `json:"retries"`
+	CompensationType    string `json:"compensationType,omitempty"`
+	Compensation        []byte `json:"compensation,omitempty"`
+	CompensationRetries int    `json:"compensationRetries,omitempty"`
+}
+
+func NewSaga() *Saga {
+	return &Saga{}
+}
+
+// Step appends a step to the saga. compensation may be nil when the step
+// has nothing to undo.
+func (s *Saga) Step(task Task, compensation Task) *Saga {
+	s.steps = append(s.steps, sagaStep{task, compensation})
+	return s
+}
+
+func (tm *TaskDispatcher) SpawnSaga(queue string, saga *Saga) (string, error) {
+	if saga == nil || len(saga.steps) == 0 {
+		return "", ErrEmptySaga
+	}
+	if tm.released.Load() {
+		return "", ErrDispatcherClosed
+	}
+
+	state := SagaState{ID: tm.newID(), Codec: tm.serializer.Codec(), Steps: make([]SagaStep, len(saga.steps))}
+	// the tasks of the steps travel with every step of the saga, so they are
+	// encrypted upfront rather than when each step is queued.
+	var key []byte
+	if tm.keys != nil {
+		keyID, current, err := tm.keys.CurrentKey()
+		if err != nil {
+			return "", err
+		}
+		state.KeyID, key = keyID, current
+	}
+
+	for i, step := range saga.steps {
+		if _, exists := tm.types.Load(step.task.Type()); !exists {
+			return "", ErrUnregisteredTask
+		}
+		encodedTask, err := tm.encodeStep(key, step.task)
+		if err != nil {
+			return "", err
+		}
+		state.Steps[i] = SagaStep{Type: step.task.Type(), Task: encodedTask, Retries: step.task.Retry()}
+
+		if step.compensation == nil {
+			continue
+		}
+		if _, exists := tm.types.Load(step.compensation.Type()); !exists {
+			return "", ErrUnregisteredTask
+		}
+		encodedCompensation, err := tm.encodeStep(key, step.compensation)
+		if err != nil {
+			return "", err
+		}
+		state.Steps[i].CompensationType = step.compensation.Type()
+		state.Steps[i].Compensation = encodedCompensation
+		state.Steps[i].CompensationRetries = step.compensation.Retry()
+	}
+
+	if _, err := tm.push(tm.ctx, queue, tm.sagaTask(state)); err != nil {
+		return "", err
+	}
+	return state.ID, nil
+}
+
+// advanceSaga queues the next task of a saga once the current one has
+// either succeeded or exhausted its retries, and records the outcome of the
+// saga once there is nothing left to queue.
+func (tm *TaskDispatcher) advanceSaga(queue string, state SagaState, succeeded bool) {
+	switch {
+	case state.Compensating:
+		if !succeeded {
+			tm.logger.Printf("dispatcher: compensation of step %d of saga %s failed, the compensations before it are not run", state.Current, state.ID)
+			tm.endSaga(queue, state, SagaAborted)
+			return
+		}
+		state.Current--
+	case succeeded:
+		state.Current++
+		if state.Current == len(state.Steps) {
+			tm.endSaga(queue, state, SagaCompleted)
+			return
+		}
+	default:
+		state.Compensating = true
+		state.Current--
+	}
+
+	if state.Compensating {
+		for state.Current >= 0 && state.Steps[state.Current].Compensation == nil {
+			state.Current--
+		}
+		if state.Current < 0 {
+			tm.endSaga(queue, state, SagaCompensated)
+			return
+		}
+	}
+
+	if err := tm.requeue(queue, tm.sagaTask(state)); err != nil {
+		tm.logger.Printf("dispatcher: failed to queue step %d of saga %s: %v", state.Current, state.ID, err)
+		tm.endSaga(queue, state, SagaAborted)
+	}
+}
+
+// endSaga records the outcome of a saga in the history under its ID, at
+// the time the outcome is known.
+func (tm *TaskDispatcher) endSaga(queue string, state SagaState, status string) {
+	now := tm.clock()
+	go tm.appendHistory(history.TaskReport{
+		Type:      SagaReportType,
+		Status:    status,
+		Queue:     queue,
+		Saga:      state.ID,
+		Submitted: now,
+		CreatedAt: now,
+	})
+}
+
+// sagaTask returns the task of the current step of a saga, or its
+// compensation while compensating.
+func (tm *TaskDispatcher) sagaTask(state SagaState) TaskWrapper {
+	step := state.Steps[state.Current]
+	wrapper := TaskWrapper{ID: tm.newID(), Type: step.Type, Codec: state.Codec, KeyID: state.KeyID, Task: step.Task, Submitted: tm.clock(), Retries: step.Retries, Saga: &state}
+	if state.Compensating {
+		wrapper.Type = step.CompensationType
+		wrapper.Task = step.Compensation
+		wrapper.Retries = step.CompensationRetries
+	}
+
+	return wrapper
+}
+
+// encodeStep encodes the task of a step, encrypting it when a key is given.
+func (tm *TaskDispatcher) encodeStep(key []byte, task Task) ([]byte, error) {
+	encodedTask, err := tm.serializer.Serialize(task)
+	if err != nil || key == nil {
+		return encodedTask, err
+	}
+
+	return seal(key, task.Type(), encodedTask)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
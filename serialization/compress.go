@@ -0,0 +1,127 @@
+package serial
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// DefaultMaxSize is the size decompressed payloads are limited to unless
+// the compressor is given another one.
+const DefaultMaxSize = 64 << 20
+
+var (
+	ErrCompression        = errors.New("failed to compress payload")
+	ErrUnknownCompression = errors.New("unknown compression")
+	ErrTooLarge           = errors.New("decompressed payload is too large")
+)
+
+// Compressor compresses encoded tasks. Name is recorded along with every
+// compressed task, so consumers decompress it with the same algorithm
+// whatever the producer was configured with.
+type Compressor interface {
+	Name() string
+	Compress(in []byte) ([]byte, error)
+	Decompress(in []byte) ([]byte, error)
+}
+
+// BuiltinCompressors returns the compressors shipped with the package.
+func BuiltinCompressors() []Compressor {
+	return []Compressor{Gzip{}, Snappy{}}
+}
+
+// Gzip is a Compressor backed by compress/gzip. Level is one of the levels
+// of compress/gzip, the default compression when zero. MaxSize limits the
+// size of decompressed payloads, DefaultMaxSize when zero.
+type Gzip struct {
+	Level   int
+	MaxSize int64
+}
+
+func (Gzip) Name() string {
+	return "gzip"
+}
+
+func (g Gzip) Compress(in []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, level)
+	if err != nil {
+		return nil, ErrCompression
+	}
+	if _, err := writer.Write(in); err != nil {
+		return nil, ErrCompression
+	}
+	if err := writer.Close(); err != nil {
+		return nil, ErrCompression
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (g Gzip) Decompress(in []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, ErrCompression
+	}
+	defer reader.Close()
+
+	// a byte past the limit tells a payload of the maximum size from a
+	// larger one.
+	maxSize := maxSize(g.MaxSize)
+	data, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, ErrCompression
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// Snappy is a Compressor writing the snappy block format, faster than Gzip
+// at the cost of larger payloads. MaxSize limits the size of decompressed
+// payloads, DefaultMaxSize when zero.
+type Snappy struct {
+	MaxSize int64
+}
+
+func (Snappy) Name() string {
+	return "snappy"
+}
+
+func (Snappy) Compress(in []byte) ([]byte, error) {
+	return snappy.Encode(nil, in), nil
+}
+
+func (s Snappy) Decompress(in []byte) ([]byte, error) {
+	// the block format records the decompressed size upfront.
+	size, err := snappy.DecodedLen(in)
+	if err != nil {
+		return nil, ErrCompression
+	}
+	if int64(size) > maxSize(s.MaxSize) {
+		return nil, ErrTooLarge
+	}
+
+	data, err := snappy.Decode(nil, in)
+	if err != nil {
+		return nil, ErrCompression
+	}
+	return data, nil
+}
+
+func maxSize(size int64) int64 {
+	if size == 0 {
+		return DefaultMaxSize
+	}
+
+	return size
+}
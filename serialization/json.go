@@ -0,0 +1,27 @@
+package serial
+
+import "encoding/json"
+
+// JSON is a Serializer backed by encoding/json, which other languages can
+// read. Tasks are encoded by their exported fields and json tags.
+type JSON struct{}
+
+func (JSON) Codec() string {
+	return "json"
+}
+
+func (JSON) Serialize(in any) ([]byte, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, ErrSerialization
+	}
+
+	return data, nil
+}
+
+func (JSON) Deserialize(in []byte, t any) error {
+	if err := json.Unmarshal(in, t); err != nil {
+		return ErrSerialization
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package serial
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// MsgPack is a Serializer backed by MessagePack, more compact than JSON and
+// still readable by other languages. Tasks are encoded by their exported
+// fields and msgpack tags.
+type MsgPack struct{}
+
+func (MsgPack) Codec() string {
+	return "msgpack"
+}
+
+func (MsgPack) Serialize(in any) ([]byte, error) {
+	data, err := msgpack.Marshal(in)
+	if err != nil {
+		return nil, ErrSerialization
+	}
+
+	return data, nil
+}
+
+func (MsgPack) Deserialize(in []byte, t any) error {
+	if err := msgpack.Unmarshal(in, t); err != nil {
+		return ErrSerialization
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 
 var (
 	ErrSerialization = errors.New("failed to serialize payload")
+	ErrUnknownCodec  = errors.New("unknown codec")
 )
 
 func RegisterType(t any) {
@@ -36,3 +37,33 @@ func Deserialize(in []byte, t any) error {
 	}
 	return nil
 }
+
+// Serializer encodes tasks and their wrappers before they are queued. Codec
+// names the encoding, which is recorded along with every encoded task so
+// that queues holding tasks of several codecs can still be read.
+type Serializer interface {
+	Codec() string
+	Serialize(in any) ([]byte, error)
+	Deserialize(in []byte, t any) error
+}
+
+// Builtin returns the serializers shipped with the package.
+func Builtin() []Serializer {
+	return []Serializer{Gob{}, JSON{}, MsgPack{}}
+}
+
+// Gob is the default Serializer, backed by encoding/gob. Tasks recorded
+// without a codec were written by it.
+type Gob struct{}
+
+func (Gob) Codec() string {
+	return "gob"
+}
+
+func (Gob) Serialize(in any) ([]byte, error) {
+	return Serialize(in)
+}
+
+func (Gob) Deserialize(in []byte, t any) error {
+	return Deserialize(in, t)
+}
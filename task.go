@@ -10,11 +10,82 @@ type Task interface {
 	Retry() int
 }
 
+// PriorityTask is implemented by tasks that should not be queued with the
+// default priority of 0. Tasks with a higher priority are dispatched first.
+type PriorityTask interface {
+	Task
+	Priority() int
+}
+
 type TaskWrapper struct {
-	Type      string
+	// ID identifies the task across retries and dead lettering.
+	ID   string
+	Type string
+	// Codec names the serializer Task was written with, which may differ
+	// from the one the wrapper itself is written with.
+	Codec string
+	// Compression names the compressor Task was compressed with, empty
+	// when it was not compressed.
+	Compression string
+	// KeyID names the key Task was encrypted with, empty when it was not
+	// encrypted.
+	KeyID     string
 	Submitted time.Time
 	Task      []byte
 	Retries   int
+	// Attempts counts the executions of the task that failed.
+	Attempts int
+	Priority int
+	Headers  map[string]string
+	Saga     *SagaState
+}
+
+// SpawnOption customizes a single spawned task.
+type SpawnOption func(*spawnOptions)
+
+type spawnOptions struct {
+	priority int
+	headers  map[string]string
+	ctx      context.Context
+}
+
+// WithPriority overrides the priority of the spawned task.
+func WithPriority(priority int) SpawnOption {
+	return func(opts *spawnOptions) {
+		opts.priority = priority
+	}
+}
+
+// WithHeader attaches a header to the spawned task. Headers are visible to
+// the queue backend, so tasks can be deleted or moved by them without being
+// decoded.
+func WithHeader(key, value string) SpawnOption {
+	return func(opts *spawnOptions) {
+		if opts.headers == nil {
+			opts.headers = make(map[string]string)
+		}
+		opts.headers[key] = value
+	}
+}
+
+// WithSpawnContext bounds how long the spawn waits for room in a full queue
+// with the Block overflow policy. Defaults to the context of the dispatcher.
+func WithSpawnContext(ctx context.Context) SpawnOption {
+	return func(opts *spawnOptions) {
+		opts.ctx = ctx
+	}
+}
+
+func newSpawnOptions(ctx context.Context, task Task, opts []SpawnOption) spawnOptions {
+	options := spawnOptions{ctx: ctx}
+	if t, ok := task.(PriorityTask); ok {
+		options.priority = t.Priority()
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
 }
 
 type Executor = func(ctx context.Context, task any) error